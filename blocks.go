@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+)
+
+/**
+ * Hashes everything read from r in a single pass, returning the hash of the
+ * whole content along with the hash of every FileChunkSize block
+ **/
+func HashBlocks(r io.Reader) (hash []byte, blocks [][]byte, err error) {
+	whole := sha1.New()
+	buf := make([]byte, FileChunkSize)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+
+		if n > 0 {
+			whole.Write(buf[:n])
+			sum := sha1.Sum(buf[:n])
+			blocks = append(blocks, sum[:])
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return whole.Sum(nil), blocks, nil
+}
+
+/**
+ * Returns the numbers of the blocks in remote that are not identical in
+ * local and thus need to be transferred
+ **/
+func DiffBlocks(local, remote [][]byte) (chunks []int64) {
+	for i, h := range remote {
+		if i >= len(local) || !bytes.Equal(local[i], h) {
+			chunks = append(chunks, int64(i))
+		}
+	}
+
+	return
+}
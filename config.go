@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"os"
+	"time"
 )
 
 const (
@@ -13,14 +14,49 @@ type JSONConfiguration struct {
 	nodeName string
 	keyPath  string
 	certPath string
-	shares   []ShareConfig
+	Shares   []ShareConfig `json:"shares"`
 	clients  []ClientConfig
 }
 
 type ShareConfig struct {
-	name                string
-	path                string
-	authorizedClientsID []string
+	Name              string   `json:"name"`
+	Path              string   `json:"path"`
+	AuthorizedClients []string `json:"authorizedClients"` //Fingerprints of the peers allowed in the share
+
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
+	PreferredPeer  string         `json:"preferredPeer,omitempty"` //Fingerprint of the peer winning conflicts
+
+	TombstoneRetention Duration `json:"tombstoneRetention,omitempty"` //Zero means DefaultTombstoneRetention
+
+	QuietPeriod   Duration `json:"quietPeriod,omitempty"`   //Zero means DefaultQuietPeriod
+	MaxEventDelay Duration `json:"maxEventDelay,omitempty"` //Zero means DefaultMaxEventDelay
+
+	RescanInterval Duration `json:"rescanInterval,omitempty"` //Zero means DefaultRescanInterval
+
+	IgnorePatterns []string `json:"ignorePatterns,omitempty"` //Added to the ones of IgnoreFileName
+
+	FollowSymlinks bool `json:"followSymlinks,omitempty"` //Sync the files links point to instead of the links
+	SyncOwnership  bool `json:"syncOwnership,omitempty"`  //Sync the owner of files, only done when running as root
+
+	SyncXattrs   bool `json:"syncXattrs,omitempty"`   //Sync the extended attributes of files
+	MaxXattrSize int  `json:"maxXattrSize,omitempty"` //Zero means DefaultMaxXattrSize
+}
+
+/**
+ * Duration of the configuration, written like "90s" or "1h30m"
+ **/
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+
+	return nil
 }
 
 type ClientConfig struct {
@@ -37,7 +73,7 @@ type ConfigurationObject interface {
 func NewJSONConfiguration(filepath string) (c *JSONConfiguration, err error) {
 	LogObj.Println("Initializing config...")
 
-	jfile, err := os.Open(DefaultConfigFile)
+	jfile, err := os.Open(filepath)
 
 	if err != nil {
 		LogObj.Println("Unable to open config file:", err)
@@ -48,6 +84,7 @@ func NewJSONConfiguration(filepath string) (c *JSONConfiguration, err error) {
 
 	jdec := json.NewDecoder(jfile)
 
+	c = &JSONConfiguration{}
 	err = jdec.Decode(c)
 
 	if err != nil {
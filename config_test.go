@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"lightsync/proto"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestShareConfigJSON(t *testing.T) {
+	var cfg ShareConfig
+
+	err := json.Unmarshal([]byte(`{
+		"name": "documents",
+		"path": "/home/user/Documents",
+		"conflictPolicy": "prefer-peer",
+		"preferredPeer": "0123456789abcdef",
+		"tombstoneRetention": "720h",
+		"quietPeriod": "2s",
+		"rescanInterval": "1h30m",
+		"ignorePatterns": ["*.tmp", "build/"],
+		"followSymlinks": true,
+		"syncXattrs": true,
+		"maxXattrSize": 4096
+	}`), &cfg)
+
+	if err != nil {
+		t.Fatal("Could not load share configuration: ", err)
+	}
+
+	s := &Share{Config: cfg}
+
+	if cfg.Name != "documents" || cfg.Path != "/home/user/Documents" {
+		t.Error("Share not loaded: ", cfg.Name, cfg.Path)
+	}
+
+	if cfg.ConflictPolicy != ConflictPreferPeer || cfg.PreferredPeer != "0123456789abcdef" {
+		t.Error("Conflict settings not loaded: ", cfg.ConflictPolicy, cfg.PreferredPeer)
+	}
+
+	if s.TombstoneRetention() != 720*time.Hour || s.QuietPeriod() != 2*time.Second ||
+		s.RescanInterval() != 90*time.Minute {
+		t.Error("Durations not loaded: ", s.TombstoneRetention(), s.QuietPeriod(),
+			s.RescanInterval())
+	}
+
+	if s.MaxEventDelay() != DefaultMaxEventDelay {
+		t.Error("Missing duration not defaulted: ", s.MaxEventDelay())
+	}
+
+	if len(cfg.IgnorePatterns) != 2 || !cfg.FollowSymlinks || cfg.SyncOwnership ||
+		!cfg.SyncXattrs || s.MaxXattrSize() != 4096 {
+		t.Error("Options not loaded: ", cfg)
+	}
+
+	for _, invalid := range []string{`{"conflictPolicy": "last-wins"}`,
+		`{"quietPeriod": "soon"}`} {
+		if json.Unmarshal([]byte(invalid), &ShareConfig{}) == nil {
+			t.Error("Invalid configuration accepted: ", invalid)
+		}
+	}
+}
+
+func TestShareConfigEnter(t *testing.T) {
+	tmp, cleanup := TempShare(t)
+	defer cleanup()
+
+	file := path.Join(tmp.Path, "lightsync.json")
+	root := path.Join(tmp.Path, "share")
+
+	os.Mkdir(root, 0755)
+
+	err := ioutil.WriteFile(file, []byte(`{"shares": [{
+		"name": "entered",
+		"path": "`+root+`",
+		"authorizedClients": ["allowed-peer"]
+	}]}`), 0644)
+
+	if err != nil {
+		t.Fatal("Could not write configuration: ", err)
+	}
+
+	cfg, err := NewJSONConfiguration(file)
+
+	if err != nil {
+		t.Fatal("Could not load configuration: ", err)
+	}
+
+	LocalFingerprint = TestPeerId
+	StartShares(cfg.Shares)
+
+	sh, ok := ShareHandlers["entered"]
+
+	if !ok {
+		t.Fatal("No handler started for the configured share")
+	}
+
+	defer func() {
+		sh.controlChannel <- 0
+		sh.Database.Close()
+		delete(ShareHandlers, "entered")
+		delete(Shares, "entered")
+	}()
+
+	other, allowed := newTestPeer("other-peer"), newTestPeer("allowed-peer")
+
+	EnterShares(other)
+	EnterShares(allowed)
+
+	select {
+	case msg := <-allowed.inputCh:
+		share, ok := msg.(*ShareMessageWrapper)
+
+		if !ok || share.GetShareName() != "entered" ||
+			share.GetAction() != light.ShareAction_ENTERING {
+			t.Error("Unexpected message on entering: ", msg)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("Allowed peer did not enter the share")
+	}
+
+	if len(other.inputCh) != 0 || sh.HasClient(other) {
+		t.Error("Peer not allowed entered the share")
+	}
+}
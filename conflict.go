@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"time"
+)
+
+/**
+ * How a share settles concurrent modifications of a file
+ * Whatever the policy, both peers must pick the same winner without talking
+ * to each other, so ties are always broken on the fingerprints
+ **/
+type ConflictPolicy int
+
+const (
+	//Winner keeps the name, the other version is kept as a conflict copy
+	ConflictKeepBoth ConflictPolicy = iota
+	//Version with the most recent modification time wins
+	ConflictNewestWins
+	//Version from the designated peer wins, newest otherwise
+	ConflictPreferPeer
+)
+
+const (
+	conflictMarker     string = ".sync-conflict-"
+	conflictDateFormat string = "20060102-150405"
+)
+
+var conflictPolicyNames = map[ConflictPolicy]string{
+	ConflictKeepBoth:   "keep-both",
+	ConflictNewestWins: "newest-mtime-wins",
+	ConflictPreferPeer: "prefer-peer",
+}
+
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	for p, n := range conflictPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+
+	return ConflictKeepBoth, errors.New("Unknown conflict policy " + name)
+}
+
+func (p ConflictPolicy) String() string {
+	return conflictPolicyNames[p]
+}
+
+func (p *ConflictPolicy) UnmarshalText(text []byte) (err error) {
+	*p, err = ParseConflictPolicy(string(text))
+	return
+}
+
+/**
+ * Name under which the version of file made by peer is kept:
+ * name.sync-conflict-<date>-<peer>.ext
+ **/
+func ConflictFileName(file string, when time.Time, peer string) string {
+	ext := path.Ext(file)
+
+	if len(peer) > 8 {
+		peer = peer[:8]
+	}
+
+	return strings.TrimSuffix(file, ext) + conflictMarker +
+		when.Format(conflictDateFormat) + "-" + peer + ext
+}
+
+/**
+ * Tells whether the version of peer, modified at mtime, should replace our
+ * own version local
+ **/
+func (s *Share) RemoteWins(local *FileEntry, mtime int64, peer string) bool {
+	if s.Config.ConflictPolicy == ConflictPreferPeer {
+		switch s.Config.PreferredPeer {
+		case peer:
+			return true
+		case LocalFingerprint:
+			return false
+		}
+	}
+
+	if mtime != local.ModTime {
+		return mtime > local.ModTime
+	}
+
+	return peer > LocalFingerprint
+}
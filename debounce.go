@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+//External imports
+import (
+	"github.com/go-fsnotify/fsnotify"
+)
+
+const (
+	//Time without events on a path before it is handled
+	DefaultQuietPeriod time.Duration = 500 * time.Millisecond
+	//Longest a path written continuously waits before being handled
+	DefaultMaxEventDelay time.Duration = 10 * time.Second
+)
+
+type pendingEvent struct {
+	op    fsnotify.Op
+	first time.Time
+	last  time.Time
+	order uint64
+}
+
+/**
+ * Coalesces the events of the watcher per path so that a file written many
+ * times in a row is only indexed and announced once
+ * A path is ready once quiet went by without events on it or maxDelay after
+ * its first event. Ready paths come out in the order they were first seen so
+ * that a removal still comes before the creation making it a rename
+ **/
+type eventDebouncer struct {
+	quiet    time.Duration
+	maxDelay time.Duration
+
+	pending map[string]*pendingEvent
+	counter uint64
+}
+
+func newEventDebouncer(quiet, maxDelay time.Duration) *eventDebouncer {
+	return &eventDebouncer{
+		quiet:    quiet,
+		maxDelay: maxDelay,
+		pending:  make(map[string]*pendingEvent),
+	}
+}
+
+func (d *eventDebouncer) Add(evt fsnotify.Event, now time.Time) {
+	p, ok := d.pending[evt.Name]
+
+	if !ok {
+		d.counter++
+		p = &pendingEvent{first: now, order: d.counter}
+		d.pending[evt.Name] = p
+	}
+
+	p.op |= evt.Op
+	p.last = now
+}
+
+func (d *eventDebouncer) deadline(p *pendingEvent) time.Time {
+	deadline := p.last.Add(d.quiet)
+
+	if max := p.first.Add(d.maxDelay); max.Before(deadline) {
+		return max
+	}
+
+	return deadline
+}
+
+/**
+ * Returns how long to wait for the next path to be ready, ok is false when
+ * there are no pending events
+ **/
+func (d *eventDebouncer) Next(now time.Time) (wait time.Duration, ok bool) {
+	for _, p := range d.pending {
+		w := d.deadline(p).Sub(now)
+
+		if !ok || w < wait {
+			wait, ok = w, true
+		}
+	}
+
+	if ok && wait < 0 {
+		wait = 0
+	}
+
+	return
+}
+
+/**
+ * Removes and returns the events of the paths that are ready, each one
+ * carrying all the operations seen on its path
+ **/
+func (d *eventDebouncer) Ready(now time.Time) (events []fsnotify.Event) {
+	var orders []uint64
+	ready := make(map[uint64]fsnotify.Event)
+
+	for name, p := range d.pending {
+		if d.deadline(p).After(now) {
+			continue
+		}
+
+		orders = append(orders, p.order)
+		ready[p.order] = fsnotify.Event{Name: name, Op: p.op}
+		delete(d.pending, name)
+	}
+
+	sort.Slice(orders, func(i, j int) bool { return orders[i] < orders[j] })
+
+	for _, o := range orders {
+		events = append(events, ready[o])
+	}
+
+	return
+}
+
+func (s *Share) QuietPeriod() time.Duration {
+	if s.Config.QuietPeriod > 0 {
+		return time.Duration(s.Config.QuietPeriod)
+	}
+
+	return DefaultQuietPeriod
+}
+
+func (s *Share) MaxEventDelay() time.Duration {
+	if s.Config.MaxEventDelay > 0 {
+		return time.Duration(s.Config.MaxEventDelay)
+	}
+
+	return DefaultMaxEventDelay
+}
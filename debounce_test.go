@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+//External imports
+import (
+	"github.com/go-fsnotify/fsnotify"
+)
+
+func TestDebounce(t *testing.T) {
+	quiet, maxDelay := 100*time.Millisecond, time.Second
+	now := time.Now()
+
+	d := newEventDebouncer(quiet, maxDelay)
+
+	d.Add(fsnotify.Event{Name: "old", Op: fsnotify.Rename}, now)
+	d.Add(fsnotify.Event{Name: "new", Op: fsnotify.Create}, now)
+	d.Add(fsnotify.Event{Name: "new", Op: fsnotify.Write}, now.Add(quiet/2))
+
+	if wait, ok := d.Next(now); !ok || wait != quiet {
+		t.Error("Unexpected wait: ", wait, ok)
+	}
+
+	events := d.Ready(now.Add(quiet))
+
+	if len(events) != 1 || events[0].Name != "old" {
+		t.Error("Only the quiet path should be ready: ", events)
+	}
+
+	events = d.Ready(now.Add(2 * quiet))
+
+	if len(events) != 1 || events[0].Op != fsnotify.Create|fsnotify.Write {
+		t.Error("Events not coalesced: ", events)
+	}
+
+	//Continuous writes are handled after maxDelay anyway
+	for at := now; at.Before(now.Add(maxDelay)); at = at.Add(quiet / 2) {
+		d.Add(fsnotify.Event{Name: "log", Op: fsnotify.Write}, at)
+	}
+
+	if events = d.Ready(now.Add(maxDelay)); len(events) != 1 {
+		t.Error("Continuously written path not ready: ", events)
+	}
+
+	if _, ok := d.Next(now); ok {
+		t.Error("Events still pending!")
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+)
+
+const (
+	//Block size used when computing signatures for delta encoding
+	DeltaBlockSize int = 64 * 1024
+
+	//Largest block size accepted in the signature of a peer
+	MaxDeltaBlockSize int = 16 * DeltaBlockSize
+
+	//Most blocks in a signature, each takes under 30 bytes once encoded so
+	//that the request fits in a frame
+	maxDeltaBlocks int64 = int64(MaxFrameSize / 64)
+
+	//Literal bytes accumulated before being flushed as a single operation
+	deltaMaxLiteral int = 4 * DeltaBlockSize
+
+	rollingMask uint32 = 0xffff
+)
+
+/**
+ * rsync style weak checksum that can be rolled over a byte stream
+ * a is the sum of the bytes, b the sum of the prefix sums, both mod 2^16
+ * uint32 overflow is harmless since 2^32 is a multiple of the modulo
+ **/
+type rollingChecksum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingChecksum(block []byte) (r *rollingChecksum) {
+	r = &rollingChecksum{n: uint32(len(block))}
+
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+	}
+
+	r.a &= rollingMask
+	r.b &= rollingMask
+
+	return
+}
+
+/**
+ * Slides the window by one byte: out leaves the window and in enters it
+ **/
+func (r *rollingChecksum) Roll(out, in byte) {
+	r.a = (r.a - uint32(out) + uint32(in)) & rollingMask
+	r.b = (r.b - r.n*uint32(out) + r.a) & rollingMask
+}
+
+func (r *rollingChecksum) Sum() uint32 {
+	return r.a | r.b<<16
+}
+
+func WeakChecksum(block []byte) uint32 {
+	return newRollingChecksum(block).Sum()
+}
+
+func StrongChecksum(block []byte) []byte {
+	sum := sha1.Sum(block)
+	return sum[:]
+}
+
+type BlockSignature struct {
+	Weak   uint32
+	Strong []byte
+}
+
+/**
+ * Signature of the copy of a file held by the receiving peer
+ * Only the last block may be shorter than BlockSize
+ **/
+type Signature struct {
+	BlockSize int
+	Blocks    []BlockSignature
+}
+
+/**
+ * One instruction to rebuild the new content from the basis file:
+ * either copy block Block of the basis or, when Block is negative, write
+ * Literal as is
+ **/
+type DeltaOp struct {
+	Block   int64
+	Literal []byte
+}
+
+/**
+ * Block size of the signature of a basis of size bytes, doubled from
+ * DeltaBlockSize until the signature fits in a frame. Zero when it does not
+ * even with MaxDeltaBlockSize, the file is then fetched block by block
+ **/
+func DeltaBlockSizeFor(size int64) int {
+	for blockSize := DeltaBlockSize; blockSize <= MaxDeltaBlockSize; blockSize *= 2 {
+		if (size+int64(blockSize)-1)/int64(blockSize) <= maxDeltaBlocks {
+			return blockSize
+		}
+	}
+
+	return 0
+}
+
+func ComputeSignature(r io.Reader, blockSize int) (sig *Signature, err error) {
+	sig = &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, BlockSignature{
+				Weak:   WeakChecksum(buf[:n]),
+				Strong: StrongChecksum(buf[:n]),
+			})
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sig, nil
+}
+
+/**
+ * Returns the index of the block of the signature matching data or -1
+ **/
+func (sig *Signature) match(table map[uint32][]int, weak uint32, data []byte) int64 {
+	candidates, found := table[weak]
+
+	if !found {
+		return -1
+	}
+
+	strong := StrongChecksum(data)
+
+	for _, i := range candidates {
+		if bytes.Equal(sig.Blocks[i].Strong, strong) {
+			return int64(i)
+		}
+	}
+
+	return -1
+}
+
+/**
+ * Computes the operations turning the content described by sig into the
+ * content read from r. Operations are handed to emit in order as soon as
+ * they are known so that arbitrarily large files can be streamed
+ **/
+func ComputeDelta(sig *Signature, r io.Reader, emit func(op DeltaOp) error) (err error) {
+	size := sig.BlockSize
+
+	//The whole window is held in memory
+	if size <= 0 || size > MaxDeltaBlockSize {
+		return errors.New("Invalid delta block size!")
+	}
+
+	table := make(map[uint32][]int)
+
+	//A short last block never matches a full window, the tail is handled apart
+	for i, b := range sig.Blocks {
+		table[b.Weak] = append(table[b.Weak], i)
+	}
+
+	var buf []byte
+	var rolling *rollingChecksum
+	var eof bool
+
+	chunk := make([]byte, size)
+
+	fill := func(n int) error {
+		for !eof && len(buf) < n {
+			read, err := r.Read(chunk)
+			buf = append(buf, chunk[:read]...)
+
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	flush := func(n int) error {
+		if n == 0 {
+			return nil
+		}
+
+		literal := make([]byte, n)
+		copy(literal, buf[:n])
+
+		return emit(DeltaOp{Block: -1, Literal: literal})
+	}
+
+	pos := 0
+
+	for {
+		err = fill(pos + size + 1)
+
+		if err != nil {
+			return
+		}
+
+		if len(buf)-pos < size {
+			break
+		}
+
+		window := buf[pos : pos+size]
+
+		if rolling == nil {
+			rolling = newRollingChecksum(window)
+		}
+
+		if block := sig.match(table, rolling.Sum(), window); block >= 0 {
+			if err = flush(pos); err != nil {
+				return
+			}
+
+			if err = emit(DeltaOp{Block: block}); err != nil {
+				return
+			}
+
+			buf = buf[pos+size:]
+			pos, rolling = 0, nil
+			continue
+		}
+
+		if len(buf) > pos+size {
+			rolling.Roll(buf[pos], buf[pos+size])
+		}
+
+		pos++
+
+		if pos >= deltaMaxLiteral {
+			if err = flush(pos); err != nil {
+				return
+			}
+
+			buf = buf[pos:]
+			pos = 0
+		}
+	}
+
+	//Less than a block left, it may still be the short tail of the basis
+	if n := len(sig.Blocks); n > 0 && len(buf) > pos {
+		tail := buf[pos:]
+		last := sig.Blocks[n-1]
+
+		if WeakChecksum(tail) == last.Weak &&
+			bytes.Equal(StrongChecksum(tail), last.Strong) {
+
+			if err = flush(pos); err != nil {
+				return
+			}
+
+			return emit(DeltaOp{Block: int64(n - 1)})
+		}
+	}
+
+	return flush(len(buf))
+}
+
+/**
+ * Writes to out the content described by ops, copying matched blocks from
+ * basis
+ **/
+func ApplyDelta(basis io.ReaderAt, blockSize int, ops []DeltaOp, out io.Writer) error {
+	block := make([]byte, blockSize)
+
+	for _, op := range ops {
+		if op.Block < 0 {
+			_, err := out.Write(op.Literal)
+
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		n, err := basis.ReadAt(block, op.Block*int64(blockSize))
+
+		if err != nil && !(err == io.EOF && n > 0) {
+			return err
+		}
+
+		_, err = out.Write(block[:n])
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	crand "crypto/rand"
+	"lightsync/proto"
+	"testing"
+)
+
+func deltaRoundTrip(t *testing.T, basis, target []byte) (literal int) {
+	sig, err := ComputeSignature(bytes.NewReader(basis), DeltaBlockSize)
+
+	if err != nil {
+		t.Fatal("Could not compute signature: ", err)
+	}
+
+	var ops []DeltaOp
+
+	err = ComputeDelta(sig, bytes.NewReader(target), func(op DeltaOp) error {
+		ops = append(ops, op)
+		literal += len(op.Literal)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal("Could not compute delta: ", err)
+	}
+
+	var out bytes.Buffer
+
+	err = ApplyDelta(bytes.NewReader(basis), DeltaBlockSize, ops, &out)
+
+	if err != nil {
+		t.Fatal("Could not apply delta: ", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), target) {
+		t.Fatal("Patched content differs from target!")
+	}
+
+	return
+}
+
+func TestRollingChecksum(t *testing.T) {
+	data := make([]byte, 3*DeltaBlockSize)
+	crand.Read(data)
+
+	rolling := newRollingChecksum(data[:DeltaBlockSize])
+
+	for i := 0; i < 2*DeltaBlockSize; i++ {
+		rolling.Roll(data[i], data[i+DeltaBlockSize])
+	}
+
+	if rolling.Sum() != WeakChecksum(data[2*DeltaBlockSize:]) {
+		t.Error("Rolled checksum differs from computed one!")
+	}
+}
+
+func TestDeltaInsertion(t *testing.T) {
+	basis := make([]byte, 10*DeltaBlockSize+123)
+	crand.Read(basis)
+
+	inserted := []byte("some bytes inserted at the start")
+	target := append(append([]byte{}, inserted...), basis...)
+
+	literal := deltaRoundTrip(t, basis, target)
+
+	if literal != len(inserted) {
+		t.Error("Expected ", len(inserted), " literal bytes, got ", literal)
+	}
+}
+
+func TestDeltaUnrelated(t *testing.T) {
+	basis := make([]byte, 2*DeltaBlockSize)
+	target := make([]byte, 5*DeltaBlockSize+7)
+
+	crand.Read(basis)
+	crand.Read(target)
+
+	if literal := deltaRoundTrip(t, basis, target); literal != len(target) {
+		t.Error("Unrelated content should be sent as literal, got ", literal)
+	}
+
+	deltaRoundTrip(t, basis, nil)
+	deltaRoundTrip(t, nil, target)
+}
+
+func TestDeltaBlockSize(t *testing.T) {
+	emit := func(op DeltaOp) error { return nil }
+
+	for _, size := range []int{0, -1, MaxDeltaBlockSize + 1} {
+		err := ComputeDelta(&Signature{BlockSize: size}, bytes.NewReader(nil), emit)
+
+		if err == nil {
+			t.Error("Block size", size, "accepted")
+		}
+	}
+}
+
+func TestDeltaBlockSizeFor(t *testing.T) {
+	for _, size := range []int64{0, 1 << 30, 200 << 30, MaxTransferSize} {
+		blockSize := DeltaBlockSizeFor(size)
+
+		if blockSize < DeltaBlockSize || blockSize > MaxDeltaBlockSize ||
+			size/int64(blockSize) > maxDeltaBlocks {
+			t.Error("Unexpected block size", blockSize, "for", size, "bytes")
+		}
+	}
+
+	if blockSize := DeltaBlockSizeFor(2 * MaxTransferSize); blockSize != 0 {
+		t.Error("Signature of", 2*MaxTransferSize, "bytes sent with blocks of", blockSize)
+	}
+
+	//The largest signature fits in a frame
+	empty := &light.DeltaRequest{Filename: proto.String("file")}
+	block := &light.DeltaRequest{Filename: proto.String("file"),
+		Weak: []uint32{^uint32(0)}, Strong: [][]byte{StrongChecksum(nil)}}
+
+	if perBlock := proto.Size(block) - proto.Size(empty); int64(perBlock)*maxDeltaBlocks >
+		int64(MaxFrameSize) {
+		t.Error("Signature of", maxDeltaBlocks, "blocks too large:", perBlock, "bytes each")
+	}
+}
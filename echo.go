@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	//How long the events caused by a change applied for a peer are expected
+	echoTimeout time.Duration = time.Minute
+)
+
+/**
+ * Change made to a path of the share on behalf of a peer. The watcher reports
+ * it like any other change and it must not be announced back as ours
+ **/
+type remoteWrite struct {
+	removed bool
+	folder  bool
+	hash    []byte
+	until   time.Time
+}
+
+func (sh *ShareHandler) expectWrite(file string, w *remoteWrite) {
+	w.until = time.Now().Add(sh.QuietPeriod() + echoTimeout)
+	sh.applied[file] = w
+}
+
+/**
+ * Records that file is about to get the content hashing to hash from a peer
+ **/
+func (sh *ShareHandler) ExpectFile(file string, hash []byte) {
+	sh.expectWrite(file, &remoteWrite{hash: hash})
+}
+
+func (sh *ShareHandler) ExpectFolder(dir string) {
+	sh.expectWrite(dir, &remoteWrite{folder: true})
+}
+
+func (sh *ShareHandler) ExpectRemoval(file string) {
+	sh.expectWrite(file, &remoteWrite{removed: true})
+}
+
+/**
+ * Tells whether file is in the state a change applied for a peer left it in,
+ * or is still being downloaded, in which case its events are not ours
+ **/
+func (sh *ShareHandler) IsEcho(file string, now time.Time) bool {
+	w, ok := sh.applied[file]
+
+	if !ok {
+		return false
+	}
+
+	_, downloading := sh.transfers[file]
+	_, patching := sh.deltas[file]
+
+	if downloading || patching {
+		return true
+	}
+
+	if now.After(w.until) || !sh.matchesWrite(file, w) {
+		//Changed locally since
+		delete(sh.applied, file)
+		return false
+	}
+
+	return true
+}
+
+func (sh *ShareHandler) matchesWrite(file string, w *remoteWrite) bool {
+	stat, err := os.Lstat(path.Join(sh.Path, file))
+
+	switch {
+	case w.removed:
+		return os.IsNotExist(err)
+
+	case err != nil:
+		return false
+
+	case w.folder:
+		return stat.IsDir()
+	}
+
+	entry, err := sh.StoredEntry(file)
+
+	if err != nil || entry == nil || entry.Deleted || !bytes.Equal(entry.Hash, w.hash) {
+		return false
+	}
+
+	modified, err := sh.CheckFileShallow(file)
+
+	return err == nil && !modified
+}
+
+/**
+ * Forgets the changes applied for peers whose events should have come by now
+ **/
+func (sh *ShareHandler) expireEchoes(now time.Time) {
+	for file, w := range sh.applied {
+		_, downloading := sh.transfers[file]
+		_, patching := sh.deltas[file]
+
+		if now.After(w.until) && !downloading && !patching {
+			delete(sh.applied, file)
+		}
+	}
+}
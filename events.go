@@ -0,0 +1,273 @@
+package main
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"lightsync/proto"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//External imports
+import (
+	"github.com/go-fsnotify/fsnotify"
+)
+
+/**
+ * Turns an event of the watcher into index updates and announces the
+ * changes to the clients of the share
+ **/
+func (sh *ShareHandler) HandleEvent(evt fsnotify.Event, now time.Time) {
+	file, err := sh.RelPath(evt.Name)
+
+	if err != nil || file == "." {
+		return
+	}
+
+	if file == IgnoreFileName {
+		err = sh.LoadIgnores()
+
+		if err != nil {
+			LogObj.Println("Could not read ignore patterns of share", sh.Name, ":", err)
+		}
+	}
+
+	if sh.Ignored(file, sh.isFolder(file)) {
+		return
+	}
+
+	if sh.IsEcho(file, now) {
+		//Applied for a peer, only the watches have to follow
+		sh.followFolder(file)
+		return
+	}
+
+	switch {
+	case evt.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		sh.handleRemoveEvent(file, now)
+
+	case evt.Op&fsnotify.Create != 0:
+		sh.handleCreateEvent(file, now)
+
+	case evt.Op&fsnotify.Chmod != 0 && sh.isFolder(file):
+		sh.AnnounceFolder(file)
+
+	case evt.Op&(fsnotify.Write|fsnotify.Chmod) != 0:
+		sh.localChange(file)
+	}
+}
+
+func isMetaPath(file string) bool {
+	return file == MetaDirName || strings.HasPrefix(file, MetaDirName+"/")
+}
+
+/**
+ * Tells whether file is a folder, or was one if it is gone
+ **/
+func (sh *ShareHandler) isFolder(file string) bool {
+	full := path.Join(sh.Path, file)
+
+	if stat, err := os.Lstat(full); err == nil {
+		return stat.IsDir()
+	}
+
+	return sh.IsWatched(full)
+}
+
+/**
+ * Watches file if it is a new folder, stops watching it if it went away
+ **/
+func (sh *ShareHandler) followFolder(file string) {
+	full := path.Join(sh.Path, file)
+
+	stat, err := os.Lstat(full)
+
+	if os.IsNotExist(err) {
+		sh.Unwatch(full)
+		return
+	}
+
+	if err != nil || !stat.IsDir() {
+		return
+	}
+
+	err = sh.Watch(full)
+
+	if err == ErrWatchLimit {
+		LogObj.Println("Can not watch", full, ", its changes will only be found by rescans:", err)
+	} else if err != nil {
+		LogObj.Println("Could not watch", full, ":", err)
+	}
+}
+
+/**
+ * Files that disappear are kept aside for a while as they may have been
+ * renamed. When a folder goes away, all the files it held do and the folder
+ * is announced as removed after them
+ **/
+func (sh *ShareHandler) handleRemoveEvent(file string, now time.Time) {
+	full := path.Join(sh.Path, file)
+
+	if _, err := os.Lstat(full); err == nil {
+		//Replaced in the meantime
+		sh.localChange(file)
+		return
+	}
+
+	for _, dir := range sh.Unwatch(full) {
+		if rel, err := sh.RelPath(dir); err == nil {
+			sh.renames.FolderRemoved(rel, now)
+		}
+	}
+
+	entry, err := sh.StoredEntry(file)
+
+	if err != nil {
+		LogObj.Println("Could not read index entry of", file, ":", err)
+		return
+	}
+
+	if entry != nil && !entry.Deleted {
+		sh.renames.Removed(entry, now)
+		return
+	}
+
+	files, err := sh.StoredFilesUnder(file)
+
+	if err != nil {
+		LogObj.Println("Could not list files of", file, ":", err)
+		return
+	}
+
+	for _, f := range files {
+		if entry, err := sh.StoredEntry(f); err == nil && entry != nil {
+			sh.renames.Removed(entry, now)
+		}
+	}
+}
+
+/**
+ * New folders are watched and walked since they may have been moved in
+ * along with their content
+ **/
+func (sh *ShareHandler) handleCreateEvent(file string, now time.Time) {
+	full := path.Join(sh.Path, file)
+
+	//Links to folders are synced as links, never walked
+	stat, err := os.Lstat(full)
+
+	if err != nil {
+		return
+	}
+
+	if !stat.IsDir() {
+		sh.newFile(file, stat)
+		return
+	}
+
+	sh.followFolder(file)
+
+	err = filepath.Walk(full, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			LogObj.Println("Could not read", p, ":", err)
+			return nil
+		}
+
+		rel, ignored := sh.walkedPath(p, info)
+
+		if ignored {
+			return skipEntry(info)
+		}
+
+		if !info.IsDir() {
+			sh.newFile(rel, info)
+			return nil
+		}
+
+		sh.AnnounceFolder(rel)
+
+		return nil
+	})
+
+	if err != nil {
+		LogObj.Println("Could not walk", full, ":", err)
+	}
+}
+
+/**
+ * Indexes a file that appeared in the share, unless it is a file that was
+ * just renamed
+ **/
+func (sh *ShareHandler) newFile(file string, stat os.FileInfo) {
+	old := sh.renames.Match(&sh.Share, file, stat)
+
+	if old == nil {
+		sh.localChange(file)
+		return
+	}
+
+	entry, err := sh.IndexRename(old.Path, file, nil)
+
+	if err != nil {
+		LogObj.Println("Could not index rename of", old.Path, "to", file, ":", err)
+		return
+	}
+
+	LogObj.Println("Detected rename of", old.Path, "to", file)
+
+	sh.AnnounceRename(old.Path, entry)
+}
+
+/**
+ * Updates the index entry of file and announces it if it changed
+ **/
+func (sh *ShareHandler) localChange(file string) {
+	if entry := sh.recordChange(file); entry != nil {
+		sh.Announce(entry)
+	}
+}
+
+/**
+ * Records and announces the removals that turned out not to be renames
+ **/
+func (sh *ShareHandler) expireRenames(now time.Time) {
+	for _, e := range sh.renames.Expired(now) {
+		sh.localChange(e.Path)
+	}
+
+	for _, dir := range sh.renames.ExpiredFolders(now) {
+		//Created again or moved back meanwhile
+		if _, err := os.Lstat(path.Join(sh.Path, dir)); err == nil {
+			continue
+		}
+
+		sh.NotifyClients(&FileMessageWrapper{MessageWrapper{nil},
+			&light.FileMessage{
+				Filename:  proto.String(dir),
+				ShareName: proto.String(sh.Name),
+				Folder:    proto.Bool(true),
+				Action:    light.FileAction_REMOVED.Enum(),
+			}})
+	}
+}
+
+/**
+ * Tells the clients of the share about a folder, created or whose mode
+ * changed
+ **/
+func (sh *ShareHandler) AnnounceFolder(dir string) {
+	msg := &light.FileMessage{
+		Filename:  proto.String(dir),
+		ShareName: proto.String(sh.Name),
+		Folder:    proto.Bool(true),
+		Action:    light.FileAction_CREATED.Enum(),
+	}
+
+	if stat, err := os.Lstat(path.Join(sh.Path, dir)); err == nil {
+		msg.Mode = proto.Uint32(fileMode(stat))
+	}
+
+	sh.NotifyClients(&FileMessageWrapper{MessageWrapper{nil}, msg})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"lightsync/proto"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFolderRemoval(t *testing.T) {
+	peer := newTestPeer("folder-peer")
+	sh, cleanup := newTestHandler(t, peer)
+	defer cleanup()
+
+	dir := path.Join(sh.Path, "removed")
+
+	err := os.MkdirAll(path.Join(dir, "sub"), 0755)
+
+	if err == nil {
+		err = sh.Watch(dir)
+	}
+
+	if err != nil {
+		t.Fatal("Could not create watched folders: ", err)
+	}
+
+	sh.AddClient(peer)
+	defer sh.RemoveClient(peer)
+
+	os.RemoveAll(dir)
+
+	now := time.Now()
+	sh.handleRemoveEvent("removed", now)
+
+	sh.expireRenames(now)
+
+	if len(peer.inputCh) != 0 {
+		t.Fatal("Folder removal announced before its files")
+	}
+
+	sh.expireRenames(now.Add(renameWindow))
+
+	for _, expected := range []string{"removed/sub", "removed"} {
+		if len(peer.inputCh) == 0 {
+			t.Fatal("Removal of", expected, "not announced")
+		}
+
+		msg, ok := (<-peer.inputCh).(*FileMessageWrapper)
+
+		if !ok || msg.GetFilename() != expected || !msg.GetFolder() ||
+			msg.GetAction() != light.FileAction_REMOVED {
+			t.Error("Unexpected announcement for", expected, ":", msg)
+		}
+	}
+}
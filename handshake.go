@@ -0,0 +1,108 @@
+package main
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"io"
+	"lightsync/proto"
+	"os"
+)
+
+const (
+	//Version of the protocol spoken by this node
+	ProtocolVersion uint32 = 1
+	//Oldest version of the protocol we can still talk with
+	MinProtocolVersion uint32 = 1
+)
+
+const (
+	//Optional protocol features, only used when both peers advertise them
+	FeatureDeltaSync string = "delta-sync"
+	FeatureTreeSync         = "tree-sync"
+)
+
+var LocalFeatures = []string{FeatureDeltaSync, FeatureTreeSync}
+
+func LocalHello() *light.Hello {
+	var name string
+
+	if Config != nil {
+		name = Config.NodeName()
+	} else {
+		name, _ = os.Hostname()
+	}
+
+	return &light.Hello{
+		ProtocolVersion: proto.Uint32(ProtocolVersion),
+		NodeName:        proto.String(name),
+		Features:        LocalFeatures,
+	}
+}
+
+/**
+ * Exchanges Hello messages with a freshly connected peer. Both sides send
+ * theirs first so the order in which peers call this does not matter
+ **/
+func ClientHandshake(conn io.ReadWriter) (hello *light.Hello, err error) {
+	_, err = WriteFrame(conn, HelloOP, LocalHello())
+
+	if err != nil {
+		return
+	}
+
+	op, data, err := ReadFrame(conn)
+
+	if err != nil {
+		return
+	}
+
+	if op != HelloOP {
+		return nil, fmt.Errorf("Expected Hello message, got message type %d", op)
+	}
+
+	hello = &light.Hello{}
+
+	err = proto.Unmarshal(data, hello)
+
+	if err != nil {
+		return nil, err
+	}
+
+	version := NegotiatedVersion(hello)
+
+	if version < MinProtocolVersion {
+		return nil, fmt.Errorf("Peer %s speaks protocol version %d, "+
+			"versions %d to %d are supported", hello.GetNodeName(),
+			hello.GetProtocolVersion(), MinProtocolVersion, ProtocolVersion)
+	}
+
+	return
+}
+
+/**
+ * The session uses the highest version known to both peers
+ **/
+func NegotiatedVersion(hello *light.Hello) uint32 {
+	if hello.GetProtocolVersion() < ProtocolVersion {
+		return hello.GetProtocolVersion()
+	}
+
+	return ProtocolVersion
+}
+
+/**
+ * Returns the features advertised by both us and the peer
+ **/
+func CommonFeatures(hello *light.Hello) (features map[string]bool) {
+	features = make(map[string]bool)
+
+	for _, remote := range hello.GetFeatures() {
+		for _, local := range LocalFeatures {
+			if remote == local {
+				features[local] = true
+			}
+		}
+	}
+
+	return
+}
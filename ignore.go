@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	//Patterns of files left out of a share, one per line like .gitignore
+	IgnoreFileName string = ".lightsyncignore"
+)
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+/**
+ * Set of gitignore style patterns. A pattern without a slash matches a name
+ * at any depth, one with a slash is relative to the share root, a trailing
+ * slash restricts it to folders and a leading ! includes back what a
+ * previous pattern excluded. The last matching pattern wins and everything
+ * below an excluded folder is excluded as well
+ **/
+type IgnoreMatcher struct {
+	patterns []ignorePattern
+}
+
+func ParseIgnorePatterns(lines []string) (m *IgnoreMatcher, err error) {
+	m = &IgnoreMatcher{}
+
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p ignorePattern
+
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+
+		if line == "" {
+			continue
+		}
+
+		expr := globToRegexp(line)
+
+		if anchored {
+			expr = "^" + expr + "$"
+		} else {
+			expr = "^(.*/)?" + expr + "$"
+		}
+
+		p.re, err = regexp.Compile(expr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		m.patterns = append(m.patterns, p)
+	}
+
+	return
+}
+
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+
+		case c == '*':
+			expr.WriteString("[^/]*")
+
+		case c == '?':
+			expr.WriteString("[^/]")
+
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+
+			class := glob[i+1 : i+1+end]
+
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return expr.String()
+}
+
+func (m *IgnoreMatcher) matchOne(file string, isDir bool) (ignored bool) {
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+
+		if p.re.MatchString(file) {
+			ignored = !p.negate
+		}
+	}
+
+	return
+}
+
+/**
+ * Tells whether file, relative to the share root, is excluded
+ **/
+func (m *IgnoreMatcher) Match(file string, isDir bool) bool {
+	if m == nil || len(m.patterns) == 0 {
+		return false
+	}
+
+	parts := strings.Split(file, "/")
+
+	for i := 1; i < len(parts); i++ {
+		if m.matchOne(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+
+	return m.matchOne(file, isDir)
+}
+
+/**
+ * Reads the patterns of the share configuration and of the ignore file at
+ * the root of the share
+ **/
+func (s *Share) LoadIgnores() error {
+	lines := append([]string{}, s.Config.IgnorePatterns...)
+
+	fd, err := os.Open(path.Join(s.Path, IgnoreFileName))
+
+	if err == nil {
+		scanner := bufio.NewScanner(fd)
+
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+
+		err = scanner.Err()
+		fd.Close()
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ignores, err := ParseIgnorePatterns(lines)
+
+	if err != nil {
+		return err
+	}
+
+	*s.ignores = *ignores
+
+	return nil
+}
+
+/**
+ * Tells whether file, relative to the share root, is left out of the share
+ **/
+func (s *Share) Ignored(file string, isDir bool) bool {
+	if file == "." {
+		return false
+	}
+
+	return isMetaPath(file) || s.ignores.Match(file, isDir)
+}
+
+/**
+ * Returns the path relative to the share root of p, a full path met while
+ * walking the share, and whether it is ignored
+ **/
+func (s *Share) walkedPath(p string, info os.FileInfo) (rel string, ignored bool) {
+	rel, err := s.RelPath(p)
+
+	return rel, err != nil || s.Ignored(rel, info.IsDir())
+}
+
+/**
+ * Walk function result leaving out the entry described by info
+ **/
+func skipEntry(info os.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIgnorePatterns(t *testing.T) {
+	m, err := ParseIgnorePatterns([]string{
+		"# editor files",
+		"*.swp",
+		"build/",
+		"/TODO",
+		"docs/**/*.pdf",
+		"*.log",
+		"!keep.log",
+		"",
+	})
+
+	if err != nil {
+		t.Fatal("Could not parse patterns: ", err)
+	}
+
+	cases := []struct {
+		file    string
+		isDir   bool
+		ignored bool
+	}{
+		{".main.go.swp", false, true},
+		{"src/.main.go.swp", false, true},
+		{"build", true, true},
+		{"build", false, false},
+		{"src/build/out.o", false, true},
+		{"TODO", false, true},
+		{"src/TODO", false, false},
+		{"docs/a/b/manual.pdf", false, true},
+		{"docs/manual.pdf", false, true},
+		{"manual.pdf", false, false},
+		{"debug.log", false, true},
+		{"logs/keep.log", false, false},
+		{"main.go", false, false},
+	}
+
+	for _, c := range cases {
+		if m.Match(c.file, c.isDir) != c.ignored {
+			t.Error("Unexpected result for", c.file, ": expected ignored", c.ignored)
+		}
+	}
+}
@@ -0,0 +1,807 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path"
+)
+
+const (
+	//Directory at the root of each share holding lightsync's own data
+	MetaDirName   string = ".lightsync"
+	IndexFileName string = "index.db"
+)
+
+/**
+ * State of a single file as last seen by this node
+ * ModTime is stored as a UTC unix timestamp, for removed files it is the
+ * time of the removal. Sequence orders the changes made to the index and is
+ * assigned when the entry is stored. Inode helps recognizing renamed files.
+ * Target is the path symlinks point to and is empty for regular files, the
+ * hash of a symlink being the one of its target. Mode holds the permission
+ * bits of the file and Uid and Gid its owner, all known only when HasMode
+ * is set as a mode of zero is a valid one. Xattrs
+ * holds its extended attributes, nil when they are not synced
+ **/
+type FileEntry struct {
+	Path     string
+	Size     int64
+	ModTime  int64
+	Hash     []byte
+	Version  int64
+	Deleted  bool
+	Vector   VersionVector
+	Sequence int64
+	Inode    uint64
+	Target   string
+	Mode     uint32
+	HasMode  bool
+	Uid      uint32
+	Gid      uint32
+	Xattrs   map[string][]byte
+}
+
+/**
+ * Download interrupted before completion: Temp is the name of the temporary
+ * file in MetaDirName and Blocks the chunks already verified in it. Meta is
+ * the entry of the peer, whose metadata the file gets once complete
+ **/
+type PartialEntry struct {
+	Path   string
+	Temp   string
+	Hash   []byte
+	Size   int64
+	Vector VersionVector
+	Blocks map[int64]bool
+	Peer   string //Name of the peer the file is fetched from
+	Meta   *FileEntry
+}
+
+/**
+ * Schema migrations for the share index, applied in order
+ * The index of a migration + 1 is the schema version it leads to and is
+ * stored in the user_version pragma of the database.
+ * Never edit an existing entry, append a new one instead!
+ **/
+var indexMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS files (
+		path    TEXT PRIMARY KEY,
+		size    INTEGER NOT NULL DEFAULT 0,
+		mtime   INTEGER NOT NULL DEFAULT 0,
+		hash    BLOB,
+		version INTEGER NOT NULL DEFAULT 0,
+		deleted INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS blocks (
+		path  TEXT NOT NULL,
+		block INTEGER NOT NULL,
+		hash  BLOB NOT NULL,
+		PRIMARY KEY (path, block)
+	)`,
+	`ALTER TABLE files ADD COLUMN vector TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS partials (
+		path   TEXT PRIMARY KEY,
+		temp   TEXT NOT NULL,
+		hash   BLOB NOT NULL,
+		size   INTEGER NOT NULL,
+		vector TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS partial_blocks (
+		path  TEXT NOT NULL,
+		block INTEGER NOT NULL,
+		PRIMARY KEY (path, block)
+	)`,
+	`ALTER TABLE files ADD COLUMN sequence INTEGER NOT NULL DEFAULT 0`,
+	`UPDATE files SET sequence = rowid`,
+	`CREATE INDEX IF NOT EXISTS files_sequence ON files (sequence)`,
+	`CREATE TABLE IF NOT EXISTS peer_sequences (
+		peer     TEXT PRIMARY KEY,
+		index_id TEXT NOT NULL,
+		sequence INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS meta (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS tree (
+		path   TEXT PRIMARY KEY,
+		parent TEXT NOT NULL,
+		folder INTEGER NOT NULL,
+		hash   BLOB
+	)`,
+	`CREATE INDEX IF NOT EXISTS tree_parent ON tree (parent)`,
+	`DELETE FROM tree WHERE folder = 0 AND path IN
+		(SELECT path FROM files WHERE deleted = 1)`,
+	`UPDATE tree SET hash = NULL WHERE folder = 1`,
+	`CREATE TABLE IF NOT EXISTS peer_acks (
+		peer     TEXT PRIMARY KEY,
+		sequence INTEGER NOT NULL
+	)`,
+	`ALTER TABLE files ADD COLUMN inode INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN target TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE files ADD COLUMN mode INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN uid INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN gid INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN xattrs TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE partials ADD COLUMN peer TEXT NOT NULL DEFAULT ''`,
+	`INSERT OR IGNORE INTO meta (key, value)
+		SELECT 'sequence', IFNULL(MAX(sequence), 0) FROM files`,
+	`ALTER TABLE partials ADD COLUMN mtime INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE partials ADD COLUMN mode INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE partials ADD COLUMN uid INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE partials ADD COLUMN gid INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE partials ADD COLUMN xattrs TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE files ADD COLUMN has_mode INTEGER NOT NULL DEFAULT 0`,
+	`UPDATE files SET has_mode = 1 WHERE mode != 0`,
+	`ALTER TABLE partials ADD COLUMN has_mode INTEGER NOT NULL DEFAULT 0`,
+	`UPDATE partials SET has_mode = 1 WHERE mode != 0`,
+}
+
+func OpenIndex(sharePath string) (db *sql.DB, err error) {
+	meta := path.Join(sharePath, MetaDirName)
+
+	err = os.MkdirAll(meta, 0700)
+
+	if err != nil {
+		return
+	}
+
+	db, err = sql.Open("sqlite3", path.Join(meta, IndexFileName))
+
+	if err != nil {
+		return
+	}
+
+	err = migrateIndex(db)
+
+	if err == nil {
+		err = initIndexID(db)
+	}
+
+	if err == nil {
+		err = initTree(db)
+	}
+
+	if err != nil {
+		db.Close()
+		db = nil
+	}
+
+	return
+}
+
+/**
+ * Gives the index a random identifier on creation. Peers use it to notice
+ * that our sequence numbers started over
+ **/
+func initIndexID(db *sql.DB) error {
+	id := make([]byte, 16)
+
+	_, err := rand.Read(id)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT OR IGNORE INTO meta (key, value) VALUES ('index_id', ?)",
+		hex.EncodeToString(id))
+
+	return err
+}
+
+func migrateIndex(db *sql.DB) (err error) {
+	var version int
+
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+
+	if err != nil {
+		return
+	}
+
+	for ; version < len(indexMigrations); version++ {
+		tx, err := db.Begin()
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(indexMigrations[version])
+
+		if err == nil {
+			//PRAGMA does not support bound parameters
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		}
+
+		if err != nil {
+			tx.Rollback()
+			LogObj.Println("Index migration to version", version+1, "failed:", err)
+			return err
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Returns the index entry for file or nil if the file was never indexed
+ **/
+func (s *Share) StoredEntry(file string) (e *FileEntry, err error) {
+	var deleted, hasMode int
+	var vector, xattrs string
+	var inode int64
+
+	e = &FileEntry{Path: file}
+
+	err = s.Database.QueryRow(
+		"SELECT size, mtime, hash, version, deleted, vector, sequence, inode, "+
+			"target, mode, has_mode, uid, gid, xattrs FROM files WHERE path = ?",
+		file).Scan(&e.Size, &e.ModTime, &e.Hash, &e.Version, &deleted, &vector,
+		&e.Sequence, &inode, &e.Target, &e.Mode, &hasMode, &e.Uid, &e.Gid, &xattrs)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	e.Deleted, e.HasMode = (deleted != 0), (hasMode != 0)
+	e.Inode = uint64(inode)
+	e.Vector, err = ParseVersionVector(vector)
+
+	if err != nil {
+		return nil, err
+	}
+
+	e.Xattrs, err = decodeXattrs(xattrs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (s *Share) StoreEntry(e *FileEntry) (err error) {
+	var deleted, hasMode int
+
+	if e.Deleted {
+		deleted = 1
+	}
+
+	if e.HasMode {
+		hasMode = 1
+	}
+
+	vector := e.Vector.String()
+
+	tx, err := s.Database.Begin()
+
+	if err != nil {
+		return
+	}
+
+	//Taken from a counter as the rows with the last sequences may be gone
+	_, err = tx.Exec("UPDATE meta SET value = CAST(value AS INTEGER) + 1 " +
+		"WHERE key = 'sequence'")
+
+	if err == nil {
+		_, err = tx.Exec(
+			"INSERT OR REPLACE INTO files "+
+				"(path, size, mtime, hash, version, deleted, vector, inode, target, "+
+				"mode, has_mode, uid, gid, xattrs, sequence) "+
+				"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, "+
+				"(SELECT CAST(value AS INTEGER) FROM meta WHERE key = 'sequence'))",
+			e.Path, e.Size, e.ModTime, e.Hash, e.Version, deleted, vector,
+			int64(e.Inode), e.Target, int64(e.Mode), hasMode, int64(e.Uid),
+			int64(e.Gid), encodeXattrs(e.Xattrs))
+	}
+
+	if err == nil && e.Deleted {
+		err = updateTree(tx, e.Path, nil)
+	} else if err == nil {
+		err = updateTree(tx, e.Path, treeLeafHash(e.Hash, vector))
+	}
+
+	if err != nil {
+		tx.Rollback()
+		LogObj.Println("Could not update index entry for", e.Path, ":", err)
+		return
+	}
+
+	return tx.Commit()
+}
+
+func (s *Share) StoredModTime(file string) (mtime int64, err error) {
+	e, err := s.StoredEntry(file)
+
+	if err != nil || e == nil {
+		return
+	}
+
+	return e.ModTime, nil
+}
+
+func (s *Share) StoredHash(file string) (hash []byte, err error) {
+	e, err := s.StoredEntry(file)
+
+	if err != nil || e == nil {
+		return
+	}
+
+	return e.Hash, nil
+}
+
+/**
+ * Returns the stored hashes of every FileChunkSize block of file, in order
+ **/
+func (s *Share) StoredBlocks(file string) (blocks [][]byte, err error) {
+	rows, err := s.Database.Query(
+		"SELECT hash FROM blocks WHERE path = ? ORDER BY block", file)
+
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash []byte
+
+		err = rows.Scan(&hash)
+
+		if err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, hash)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (s *Share) StoreBlocks(file string, blocks [][]byte) (err error) {
+	tx, err := s.Database.Begin()
+
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM blocks WHERE path = ?", file)
+
+	for i := 0; err == nil && i < len(blocks); i++ {
+		_, err = tx.Exec("INSERT INTO blocks (path, block, hash) VALUES (?, ?, ?)",
+			file, i, blocks[i])
+	}
+
+	if err != nil {
+		tx.Rollback()
+		LogObj.Println("Could not update block hashes of", file, ":", err)
+		return
+	}
+
+	return tx.Commit()
+}
+
+/**
+ * Returns the partial download of file or nil if there is none
+ **/
+func (s *Share) StoredPartial(file string) (p *PartialEntry, err error) {
+	var vector, xattrs string
+	var mode, hasMode, uid, gid int64
+
+	p = &PartialEntry{Path: file, Blocks: make(map[int64]bool)}
+	p.Meta = &FileEntry{Path: file}
+
+	err = s.Database.QueryRow(
+		"SELECT temp, hash, size, vector, peer, mtime, mode, has_mode, uid, gid, "+
+			"xattrs FROM partials WHERE path = ?",
+		file).Scan(&p.Temp, &p.Hash, &p.Size, &vector, &p.Peer, &p.Meta.ModTime,
+		&mode, &hasMode, &uid, &gid, &xattrs)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.Vector, err = ParseVersionVector(vector)
+
+	if err == nil {
+		p.Meta.Xattrs, err = decodeXattrs(xattrs)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.Meta.Hash, p.Meta.Size = p.Hash, p.Size
+	p.Meta.Mode, p.Meta.Uid, p.Meta.Gid = uint32(mode), uint32(uid), uint32(gid)
+	p.Meta.HasMode = (hasMode != 0)
+
+	rows, err := s.Database.Query(
+		"SELECT block FROM partial_blocks WHERE path = ?", file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var block int64
+
+		err = rows.Scan(&block)
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.Blocks[block] = true
+	}
+
+	return p, rows.Err()
+}
+
+/**
+ * Records p, replacing any previous partial download of the same file
+ **/
+func (s *Share) StorePartial(p *PartialEntry) (err error) {
+	tx, err := s.Database.Begin()
+
+	if err != nil {
+		return
+	}
+
+	var hasMode int
+
+	meta := p.Meta
+
+	if meta == nil {
+		meta = &FileEntry{}
+	}
+
+	if meta.HasMode {
+		hasMode = 1
+	}
+
+	_, err = tx.Exec("DELETE FROM partial_blocks WHERE path = ?", p.Path)
+
+	if err == nil {
+		_, err = tx.Exec("INSERT OR REPLACE INTO partials "+
+			"(path, temp, hash, size, vector, peer, mtime, mode, has_mode, uid, gid, "+
+			"xattrs) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			p.Path, p.Temp, p.Hash, p.Size, p.Vector.String(), p.Peer, meta.ModTime,
+			int64(meta.Mode), hasMode, int64(meta.Uid), int64(meta.Gid),
+			encodeXattrs(meta.Xattrs))
+	}
+
+	for block := range p.Blocks {
+		if err != nil {
+			break
+		}
+
+		_, err = tx.Exec("INSERT INTO partial_blocks (path, block) VALUES (?, ?)",
+			p.Path, block)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		LogObj.Println("Could not record partial download of", p.Path, ":", err)
+		return
+	}
+
+	return tx.Commit()
+}
+
+func (s *Share) StorePartialBlock(file string, block int64) (err error) {
+	_, err = s.Database.Exec(
+		"INSERT OR REPLACE INTO partial_blocks (path, block) VALUES (?, ?)",
+		file, block)
+
+	return
+}
+
+/**
+ * Forgets the partial download of file. The temporary file is removed as
+ * well unless it was already moved into place
+ **/
+func (s *Share) RemovePartial(file string) (err error) {
+	p, err := s.StoredPartial(file)
+
+	if err != nil || p == nil {
+		return
+	}
+
+	os.Remove(path.Join(s.Path, MetaDirName, p.Temp))
+
+	_, err = s.Database.Exec("DELETE FROM partial_blocks WHERE path = ?", file)
+
+	if err == nil {
+		_, err = s.Database.Exec("DELETE FROM partials WHERE path = ?", file)
+	}
+
+	return
+}
+
+/**
+ * Returns the files whose partial download is fetched from peer
+ **/
+func (s *Share) PartialsFrom(peer string) (files []string, err error) {
+	rows, err := s.Database.Query("SELECT path FROM partials WHERE peer = ?", peer)
+
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var file string
+
+		err = rows.Scan(&file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, file)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+/**
+ * Returns the names of the temporary files of every partial download
+ **/
+func (s *Share) PartialTemps() (temps map[string]bool, err error) {
+	temps = make(map[string]bool)
+
+	rows, err := s.Database.Query("SELECT temp FROM partials")
+
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var temp string
+
+		err = rows.Scan(&temp)
+
+		if err != nil {
+			return
+		}
+
+		temps[temp] = true
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+/**
+ * Calls fn on every entry of the index changed after sequence since, in
+ * sequence order. fn must not use the database as the entries are read
+ * while it runs
+ **/
+func (s *Share) ForEachEntry(since int64, fn func(e *FileEntry) error) (err error) {
+	rows, err := s.Database.Query(
+		"SELECT path, size, mtime, hash, version, deleted, vector, sequence, "+
+			"inode, target, mode, has_mode, uid, gid, xattrs FROM files "+
+			"WHERE sequence > ? ORDER BY sequence", since)
+
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var deleted, hasMode int
+		var vector, xattrs string
+		var inode int64
+
+		e := &FileEntry{}
+
+		err = rows.Scan(&e.Path, &e.Size, &e.ModTime, &e.Hash, &e.Version,
+			&deleted, &vector, &e.Sequence, &inode, &e.Target, &e.Mode, &hasMode,
+			&e.Uid, &e.Gid, &xattrs)
+
+		if err != nil {
+			return
+		}
+
+		e.Deleted, e.HasMode = (deleted != 0), (hasMode != 0)
+		e.Inode = uint64(inode)
+		e.Vector, err = ParseVersionVector(vector)
+
+		if err != nil {
+			return
+		}
+
+		e.Xattrs, err = decodeXattrs(xattrs)
+
+		if err != nil {
+			return
+		}
+
+		err = fn(e)
+
+		if err != nil {
+			return
+		}
+	}
+
+	return rows.Err()
+}
+
+/**
+ * Returns the paths of the files not removed below folder dir
+ **/
+func (s *Share) StoredFilesUnder(dir string) (files []string, err error) {
+	//Paths between "dir/" and "dir0" all start with "dir/"
+	rows, err := s.Database.Query("SELECT path FROM files "+
+		"WHERE path > ? AND path < ? AND deleted = 0", dir+"/", dir+"0")
+
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var file string
+
+		err = rows.Scan(&file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+func (s *Share) IndexID() (id string, err error) {
+	err = s.Database.QueryRow(
+		"SELECT value FROM meta WHERE key = 'index_id'").Scan(&id)
+
+	return
+}
+
+/**
+ * Returns the identifier of the index of peer and the last sequence number
+ * of it we reconciled, or an empty id if we never did
+ **/
+func (s *Share) PeerSequence(peer string) (indexID string, sequence int64, err error) {
+	err = s.Database.QueryRow(
+		"SELECT index_id, sequence FROM peer_sequences WHERE peer = ?",
+		peer).Scan(&indexID, &sequence)
+
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+
+	return
+}
+
+func (s *Share) StorePeerSequence(peer, indexID string, sequence int64) (err error) {
+	_, err = s.Database.Exec("INSERT OR REPLACE INTO peer_sequences "+
+		"(peer, index_id, sequence) VALUES (?, ?, ?)", peer, indexID, sequence)
+
+	return
+}
+
+/**
+ * Records that peer has seen our index up to sequence. Acknowledgements
+ * never go back, peers are only told about changes after them
+ **/
+func (s *Share) StorePeerAck(peer string, sequence int64) (err error) {
+	_, err = s.Database.Exec("INSERT OR REPLACE INTO peer_acks (peer, sequence) "+
+		"VALUES (?, MAX(?, IFNULL((SELECT sequence FROM peer_acks WHERE peer = ?), 0)))",
+		peer, sequence, peer)
+
+	return
+}
+
+/**
+ * Returns the last sequence number given to a change, the entry holding it
+ * may have been collected since
+ **/
+func (s *Share) MaxSequence() (sequence int64, err error) {
+	err = s.Database.QueryRow(
+		"SELECT CAST(value AS INTEGER) FROM meta WHERE key = 'sequence'").Scan(&sequence)
+
+	return
+}
+
+/**
+ * Forgets the removals made before the given time that every peer which
+ * ever entered the share or is allowed in it has acknowledged
+ **/
+func (s *Share) CollectTombstones(before int64) (collected int64, err error) {
+	var peers int
+	var acked sql.NullInt64
+
+	err = s.Database.QueryRow(
+		"SELECT COUNT(*), MIN(sequence) FROM peer_acks").Scan(&peers, &acked)
+
+	if err != nil {
+		return
+	}
+
+	limit := int64(math.MaxInt64)
+
+	if peers > 0 {
+		limit = acked.Int64
+	}
+
+	//Peers that never entered still have every file we removed
+	for _, peer := range s.Config.AuthorizedClients {
+		var sequence int64
+
+		err = s.Database.QueryRow("SELECT sequence FROM peer_acks WHERE peer = ?",
+			peer).Scan(&sequence)
+
+		if err == sql.ErrNoRows {
+			sequence, err = 0, nil
+		}
+
+		if err != nil {
+			return
+		}
+
+		if sequence < limit {
+			limit = sequence
+		}
+	}
+
+	tx, err := s.Database.Begin()
+
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM blocks WHERE path IN (SELECT path FROM files "+
+		"WHERE deleted = 1 AND mtime < ? AND sequence <= ?)", before, limit)
+
+	if err == nil {
+		var res sql.Result
+
+		res, err = tx.Exec("DELETE FROM files "+
+			"WHERE deleted = 1 AND mtime < ? AND sequence <= ?", before, limit)
+
+		if err == nil {
+			collected, err = res.RowsAffected()
+		}
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return collected, tx.Commit()
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"lightsync/proto"
+)
+
+const (
+	//Most files sent in a single IndexMessage
+	indexBatchSize int = 1000
+
+	//Most bytes the files of a single IndexMessage take once encoded, the
+	//rest of the frame is left to the other fields
+	indexBatchBytes int = MaxFrameSize - 1024*1024
+)
+
+/**
+ * IndexMessage of a peer whose sequence is only stored once the files it
+ * made us fetch, pending, are committed
+ **/
+type indexBatch struct {
+	indexID  string
+	sequence int64
+	pending  map[string]bool
+}
+
+func entryToProto(e *FileEntry) *light.IndexEntry {
+	pb := &light.IndexEntry{
+		Filename: proto.String(e.Path),
+		Hash:     e.Hash,
+		Size:     proto.Int64(e.Size),
+		Mtime:    proto.Int64(e.ModTime),
+		Version:  e.Vector.Proto(),
+		Deleted:  proto.Bool(e.Deleted),
+	}
+
+	pb.Type, pb.Target = fileTypeToProto(e)
+	pb.Mode, pb.Uid, pb.Gid = metadataToProto(e)
+	pb.Xattrs = xattrsToProto(e.Xattrs)
+
+	return pb
+}
+
+func entryFromProto(pb *light.IndexEntry) *FileEntry {
+	return &FileEntry{
+		Path:    pb.GetFilename(),
+		Hash:    pb.GetHash(),
+		Size:    pb.GetSize(),
+		ModTime: pb.GetMtime(),
+		Vector:  VersionVectorFromProto(pb.GetVersion()),
+		Deleted: pb.GetDeleted(),
+		Target:  targetFromProto(pb.GetType(), pb.GetTarget()),
+		Mode:    pb.GetMode(),
+		HasMode: pb.Mode != nil,
+		Uid:     pb.GetUid(),
+		Gid:     pb.GetGid(),
+		Xattrs:  xattrsFromProto(pb.GetXattrs()),
+	}
+}
+
+/**
+ * Encoded size of pb as one of the files of an IndexMessage
+ **/
+func indexEntrySize(pb *light.IndexEntry) int {
+	n := proto.Size(pb)
+	return 1 + len(proto.EncodeVarint(uint64(n))) + n
+}
+
+/**
+ * Tells whether a batch of count files taking size bytes is full, so that
+ * a file taking next bytes goes in another one. A file larger than maxBytes
+ * goes alone in its batch
+ **/
+func indexBatchFull(count, size, next, maxBytes int) bool {
+	return count >= indexBatchSize || (count > 0 && size+next > maxBytes)
+}
+
+/**
+ * Number of the first entries going in the next IndexMessage
+ **/
+func nextIndexBatch(entries []*light.IndexEntry, maxBytes int) (n int) {
+	size := 0
+
+	for n < len(entries) {
+		next := indexEntrySize(entries[n])
+
+		if indexBatchFull(n, size, next, maxBytes) {
+			break
+		}
+
+		size += next
+		n++
+	}
+
+	return
+}
+
+/**
+ * Tells the clients of the share about a local change to a file
+ **/
+func (sh *ShareHandler) Announce(e *FileEntry) {
+	action := light.FileAction_UPDATED
+
+	if e.Deleted {
+		action = light.FileAction_REMOVED
+	}
+
+	msg := &light.FileMessage{
+		Filename:  proto.String(e.Path),
+		ShareName: proto.String(sh.Name),
+		Folder:    proto.Bool(false),
+		Action:    action.Enum(),
+		Hash:      e.Hash,
+		Version:   e.Vector.Proto(),
+		Mtime:     proto.Int64(e.ModTime),
+	}
+
+	msg.Type, msg.Target = fileTypeToProto(e)
+	msg.Mode, msg.Uid, msg.Gid = metadataToProto(e)
+	msg.Xattrs = xattrsToProto(e.Xattrs)
+
+	sh.NotifyClients(&FileMessageWrapper{MessageWrapper{nil}, msg})
+}
+
+/**
+ * Registers peer as a client of the share and tells it we are entering so
+ * that it sends back the part of its index we have not seen yet, then
+ * resumes the downloads peer was the source of
+ **/
+func (sh *ShareHandler) Enter(peer *Client) {
+	if !sh.Authorized(peer) {
+		LogObj.Println("Peer", peer.Name(), "is not allowed in share", sh.Name)
+		return
+	}
+
+	sh.AddClient(peer)
+
+	indexID, since, err := sh.PeerSequence(peer.Name())
+
+	if err != nil {
+		LogObj.Println("Could not read sequence of", peer.Name(), ":", err)
+		indexID, since = "", 0
+	}
+
+	//The batches after since are sent again
+	delete(sh.batches, peer.Name())
+
+	peer.WriteMessage(&ShareMessageWrapper{MessageWrapper{nil},
+		&light.ShareMessage{
+			ShareName: proto.String(sh.Name),
+			Action:    light.ShareAction_ENTERING.Enum(),
+			IndexId:   proto.String(indexID),
+			Since:     proto.Int64(since),
+		}})
+
+	//Downloads interrupted by a disconnection do not wait for announcements
+	sh.ResumeTransfers(peer)
+}
+
+/**
+ * Sends to peer the files of our index changed after sequence since, in
+ * batches small enough to fit in a frame. The whole index is sent when the peer
+ * knows another index than ours, e.g. because the database was recreated
+ **/
+func (sh *ShareHandler) SendIndex(peer *Client, indexID string, since int64) {
+	ourID, err := sh.IndexID()
+
+	if err != nil {
+		LogObj.Println("Could not read index of share", sh.Name, ":", err)
+		return
+	}
+
+	//The peer has seen everything up to since, or nothing yet
+	if indexID == ourID {
+		sh.Acknowledge(peer, since)
+	} else {
+		sh.Acknowledge(peer, 0)
+	}
+
+	if indexID != ourID {
+		//Walking the trees only sends the files that differ
+		if peer.HasFeature(FeatureTreeSync) {
+			sh.CompareTree(peer, ourID)
+			return
+		}
+
+		since = 0
+	}
+
+	newBatch := func() *light.IndexMessage {
+		return &light.IndexMessage{
+			ShareName: proto.String(sh.Name),
+			IndexId:   proto.String(ourID),
+		}
+	}
+
+	batch, size, count := newBatch(), 0, 0
+
+	//Entries come in sequence order so every batch carries its highest one
+	err = sh.ForEachEntry(since, func(e *FileEntry) error {
+		pb := entryToProto(e)
+		next := indexEntrySize(pb)
+
+		if indexBatchFull(len(batch.Files), size, next, indexBatchBytes) {
+			peer.WriteMessage(&IndexMessageWrapper{MessageWrapper{nil}, batch})
+			batch, size = newBatch(), 0
+		}
+
+		batch.Files = append(batch.Files, pb)
+		batch.Sequence = proto.Int64(e.Sequence)
+		size += next
+		count++
+
+		return nil
+	})
+
+	if err != nil {
+		LogObj.Println("Could not read index of share", sh.Name, ":", err)
+		return
+	}
+
+	batch.Last = proto.Bool(true)
+
+	peer.WriteMessage(&IndexMessageWrapper{MessageWrapper{nil}, batch})
+
+	LogObj.Println("Sent", count, "changed files since", since, "to", peer.Name())
+}
+
+/**
+ * Reconciles every file of the index of a peer with ours, pulling what we
+ * are missing
+ **/
+func (sh *ShareHandler) HandleIndex(msg *IndexMessageWrapper) {
+	if msg.GetShareName() != sh.Name {
+		LogObj.Println("Ignoring message meant for share", msg.GetShareName())
+		return
+	}
+
+	peer := msg.Sender()
+
+	batch := &indexBatch{
+		indexID:  msg.GetIndexId(),
+		sequence: msg.GetSequence(),
+		pending:  make(map[string]bool),
+	}
+
+	for _, f := range msg.GetFiles() {
+		sh.Reconcile(peer, entryFromProto(f))
+
+		if sh.fetching(peer, f.GetFilename()) {
+			batch.pending[f.GetFilename()] = true
+		}
+	}
+
+	//Next time we enter, only ask for what changed after this batch. The
+	//batches of a tree comparison carry none but come before the one that
+	//ends it
+	if msg.Sequence == nil {
+		batch.indexID = ""
+	}
+
+	if batch.indexID != "" || len(batch.pending) > 0 {
+		sh.batches[peer.Name()] = append(sh.batches[peer.Name()], batch)
+		sh.storeSequence(peer)
+	}
+
+	if msg.GetLast() {
+		LogObj.Println("Index of", msg.Sender().Name(), "reconciled")
+	}
+}
+
+/**
+ * Tells whether file is being downloaded from peer
+ **/
+func (sh *ShareHandler) fetching(peer *Client, file string) bool {
+	if t, pending := sh.transfers[file]; pending && t.peer == peer {
+		return true
+	}
+
+	t, pending := sh.deltas[file]
+
+	return pending && t.peer == peer
+}
+
+/**
+ * Called once file, fetched from peer, is committed
+ **/
+func (sh *ShareHandler) fetched(peer *Client, file string) {
+	for _, b := range sh.batches[peer.Name()] {
+		delete(b.pending, file)
+	}
+
+	sh.storeSequence(peer)
+}
+
+/**
+ * Stores the sequence of the last batch of peer whose files, and the ones of
+ * every batch before it, are all committed. The batches after it are sent
+ * again when we enter next time if they never complete
+ **/
+func (sh *ShareHandler) storeSequence(peer *Client) {
+	batches := sh.batches[peer.Name()]
+
+	var done *indexBatch
+
+	for len(batches) > 0 && len(batches[0].pending) == 0 {
+		if batches[0].indexID != "" {
+			done = batches[0]
+		}
+
+		batches = batches[1:]
+	}
+
+	sh.batches[peer.Name()] = batches
+
+	if done == nil {
+		return
+	}
+
+	err := sh.StorePeerSequence(peer.Name(), done.indexID, done.sequence)
+
+	if err != nil {
+		LogObj.Println("Could not store sequence of", peer.Name(), ":", err)
+	}
+}
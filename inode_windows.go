@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+/**
+ * Windows has no inode numbers, renames are matched on content only
+ **/
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"code.google.com/p/goprotobuf/proto"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"lightsync/proto"
 )
@@ -11,12 +13,30 @@ const (
 	FileMessageOP  byte = 0x1
 	ShareMessageOP      = 0x2
 	PeerMessageOP       = 0x3
+	BlockListOP         = 0x4
+	ChunkRequestOP      = 0x5
+	ChunkDataOP         = 0x6
+	DeltaRequestOP      = 0x7
+	DeltaDataOP         = 0x8
+	HelloOP             = 0x9
+	IndexMessageOP      = 0xa
+	TreeMessageOP       = 0xb
 )
 
+const (
+	//Frames are made of a one byte opcode and a big endian int32 length
+	FrameHeaderSize int = 5
+
+	//Largest payload accepted, enough for the signature of a 64GiB file
+	MaxFrameSize int = 64 * 1024 * 1024
+)
+
+var ErrFrameTooLarge = errors.New("Frame exceeds the maximum frame size!")
+
 type Message interface {
 	SetSender(client *Client)
 	Sender() *Client
-	WriteTo(writer io.Writer) error
+	WriteTo(writer io.Writer) (int64, error)
 }
 
 type MessageHandler interface {
@@ -42,71 +62,148 @@ type ShareMessageWrapper struct {
 	*light.ShareMessage
 }
 
-func (w *MessageWrapper) SetSender(sender *Client) {
+type BlockListWrapper struct {
+	MessageWrapper
+	*light.BlockList
+}
+
+type ChunkRequestWrapper struct {
+	MessageWrapper
+	*light.ChunkRequest
+}
+
+type ChunkDataWrapper struct {
+	MessageWrapper
+	*light.ChunkData
+}
+
+type DeltaRequestWrapper struct {
+	MessageWrapper
+	*light.DeltaRequest
+}
+
+type DeltaDataWrapper struct {
+	MessageWrapper
+	*light.DeltaData
+}
+
+type IndexMessageWrapper struct {
+	MessageWrapper
+	*light.IndexMessage
+}
+
+type TreeMessageWrapper struct {
+	MessageWrapper
+	*light.TreeMessage
+}
 
+func (w *MessageWrapper) SetSender(sender *Client) {
+	w.sender = sender
 }
 
 func (w *MessageWrapper) Sender() (c *Client) {
 	return w.sender
 }
 
-func (w *FileMessageWrapper) WriteTo(writer io.Writer) (err error) {
-	data, err := proto.Marshal(w)
+func (w *FileMessageWrapper) WriteTo(writer io.Writer) (int64, error) {
+	return WriteFrame(writer, FileMessageOP, w.FileMessage)
+}
 
-	if err != nil {
-		return
-	}
+func (w *PeerMessageWrapper) WriteTo(writer io.Writer) (int64, error) {
+	return WriteFrame(writer, PeerMessageOP, w.PeerMessage)
+}
 
-	_, err = writer.Write(data)
+func (w *ShareMessageWrapper) WriteTo(writer io.Writer) (int64, error) {
+	return WriteFrame(writer, ShareMessageOP, w.ShareMessage)
+}
 
-	return
+func (w *BlockListWrapper) WriteTo(writer io.Writer) (int64, error) {
+	return WriteFrame(writer, BlockListOP, w.BlockList)
 }
 
-func (w *PeerMessageWrapper) WriteTo(writer io.Writer) (err error) {
-	data, err := proto.Marshal(w)
+func (w *ChunkRequestWrapper) WriteTo(writer io.Writer) (int64, error) {
+	return WriteFrame(writer, ChunkRequestOP, w.ChunkRequest)
+}
 
-	if err != nil {
-		return
-	}
+func (w *ChunkDataWrapper) WriteTo(writer io.Writer) (int64, error) {
+	return WriteFrame(writer, ChunkDataOP, w.ChunkData)
+}
 
-	_, err = writer.Write(data)
+func (w *DeltaRequestWrapper) WriteTo(writer io.Writer) (int64, error) {
+	return WriteFrame(writer, DeltaRequestOP, w.DeltaRequest)
+}
 
-	return
+func (w *DeltaDataWrapper) WriteTo(writer io.Writer) (int64, error) {
+	return WriteFrame(writer, DeltaDataOP, w.DeltaData)
+}
+
+func (w *IndexMessageWrapper) WriteTo(writer io.Writer) (int64, error) {
+	return WriteFrame(writer, IndexMessageOP, w.IndexMessage)
 }
 
-func (w *ShareMessageWrapper) WriteTo(writer io.Writer) (err error) {
-	data, err := proto.Marshal(w)
+func (w *TreeMessageWrapper) WriteTo(writer io.Writer) (int64, error) {
+	return WriteFrame(writer, TreeMessageOP, w.TreeMessage)
+}
+
+/**
+ * Writes pb as a single frame: opcode, payload length and payload
+ **/
+func WriteFrame(writer io.Writer, op byte, pb proto.Message) (n int64, err error) {
+	data, err := proto.Marshal(pb)
 
 	if err != nil {
 		return
 	}
 
-	_, err = writer.Write(data)
+	if len(data) > MaxFrameSize {
+		return 0, ErrFrameTooLarge
+	}
 
-	return
+	//Header and payload are written at once so frames never interleave
+	frame := make([]byte, FrameHeaderSize, FrameHeaderSize+len(data))
+	frame[0] = op
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	frame = append(frame, data...)
+
+	written, err := writer.Write(frame)
+
+	return int64(written), err
 }
 
-func ReadMessage(reader io.Reader) (msg Message, err error) {
-	var length int32
-	var mtype byte
+/**
+ * Reads a whole frame written by WriteFrame
+ **/
+func ReadFrame(reader io.Reader) (op byte, data []byte, err error) {
+	header := make([]byte, FrameHeaderSize)
 
-	err = binary.Read(reader, binary.BigEndian, &mtype)
+	_, err = io.ReadFull(reader, header)
 
 	if err != nil {
 		return
 	}
 
-	err = binary.Read(reader, binary.BigEndian, &length)
+	length := int32(binary.BigEndian.Uint32(header[1:]))
 
-	if err != nil {
-		return
+	if length < 0 || int(length) > MaxFrameSize {
+		return 0, nil, ErrFrameTooLarge
 	}
 
-	data := make([]byte, length)
+	data = make([]byte, length)
+
+	_, err = io.ReadFull(reader, data)
+
+	if err == io.EOF {
+		//The header was read, the stream can not end here
+		err = io.ErrUnexpectedEOF
+	}
+
+	return header[0], data, err
+}
 
-	n, err := reader.Read(data)
+func ReadMessage(reader io.Reader) (msg Message, err error) {
+	mtype, data, err := ReadFrame(reader)
 
-	if err != nil || int32(n) != length {
+	if err != nil {
 		LogObj.Println("Message reading error:", err)
 		return
 	}
@@ -127,8 +224,47 @@ func ReadMessage(reader io.Reader) (msg Message, err error) {
 		err = proto.Unmarshal(data, pb)
 		msg = &PeerMessageWrapper{MessageWrapper{nil}, pb}
 
+	case BlockListOP:
+		pb := &light.BlockList{}
+		err = proto.Unmarshal(data, pb)
+		msg = &BlockListWrapper{MessageWrapper{nil}, pb}
+
+	case ChunkRequestOP:
+		pb := &light.ChunkRequest{}
+		err = proto.Unmarshal(data, pb)
+		msg = &ChunkRequestWrapper{MessageWrapper{nil}, pb}
+
+	case ChunkDataOP:
+		pb := &light.ChunkData{}
+		err = proto.Unmarshal(data, pb)
+		msg = &ChunkDataWrapper{MessageWrapper{nil}, pb}
+
+	case DeltaRequestOP:
+		pb := &light.DeltaRequest{}
+		err = proto.Unmarshal(data, pb)
+		msg = &DeltaRequestWrapper{MessageWrapper{nil}, pb}
+
+	case DeltaDataOP:
+		pb := &light.DeltaData{}
+		err = proto.Unmarshal(data, pb)
+		msg = &DeltaDataWrapper{MessageWrapper{nil}, pb}
+
+	case IndexMessageOP:
+		pb := &light.IndexMessage{}
+		err = proto.Unmarshal(data, pb)
+		msg = &IndexMessageWrapper{MessageWrapper{nil}, pb}
+
+	case TreeMessageOP:
+		pb := &light.TreeMessage{}
+		err = proto.Unmarshal(data, pb)
+		msg = &TreeMessageWrapper{MessageWrapper{nil}, pb}
+
 	default:
-		panic("Invalid message type received!" + string(mtype))
+		return nil, fmt.Errorf("Invalid message type %d received!", mtype)
+	}
+
+	if err != nil {
+		msg = nil
 	}
 
 	return
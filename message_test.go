@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"io"
+	"lightsync/proto"
+	"log"
+	"net"
+	"os"
+	"testing"
+)
+
+func initLog() {
+	if LogObj == nil {
+		LogObj = log.New(os.Stdout, "lightsync: ", log.LstdFlags)
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	initLog()
+
+	var buf bytes.Buffer
+
+	file := &FileMessageWrapper{MessageWrapper{nil}, &light.FileMessage{
+		Filename:  proto.String("dir/file.txt"),
+		ShareName: proto.String("test"),
+		Folder:    proto.Bool(false),
+		Action:    light.FileAction_UPDATED.Enum(),
+		Hash:      []byte{1, 2, 3},
+	}}
+
+	chunk := &ChunkDataWrapper{MessageWrapper{nil}, &light.ChunkData{
+		Filename:  proto.String("dir/file.txt"),
+		ShareName: proto.String("test"),
+		Hash:      []byte{1, 2, 3},
+		Chunk:     proto.Int64(42),
+		Data:      make([]byte, FileChunkSize),
+	}}
+
+	for _, msg := range []Message{file, chunk} {
+		n, err := msg.WriteTo(&buf)
+
+		if err != nil {
+			t.Fatal("Could not write message: ", err)
+		}
+
+		if n < int64(FrameHeaderSize) {
+			t.Fatal("Short frame written: ", n)
+		}
+	}
+
+	msg, err := ReadMessage(&buf)
+
+	if err != nil {
+		t.Fatal("Could not read first message: ", err)
+	}
+
+	rfile, ok := msg.(*FileMessageWrapper)
+
+	if !ok || rfile.GetFilename() != "dir/file.txt" ||
+		rfile.GetAction() != light.FileAction_UPDATED ||
+		!bytes.Equal(rfile.GetHash(), []byte{1, 2, 3}) {
+		t.Error("First message differs from the one written: ", msg)
+	}
+
+	msg, err = ReadMessage(&buf)
+
+	if err != nil {
+		t.Fatal("Could not read second message: ", err)
+	}
+
+	rchunk, ok := msg.(*ChunkDataWrapper)
+
+	if !ok || rchunk.GetChunk() != 42 || int64(len(rchunk.GetData())) != FileChunkSize {
+		t.Error("Second message differs from the one written")
+	}
+
+	if _, err = ReadMessage(&buf); err != io.EOF {
+		t.Error("Expected EOF after the last frame, got ", err)
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	initLog()
+
+	_, _, err := ReadFrame(bytes.NewReader([]byte{FileMessageOP, 0x7f, 0, 0, 0}))
+
+	if err != ErrFrameTooLarge {
+		t.Error("Oversized frame was not rejected: ", err)
+	}
+
+	_, _, err = ReadFrame(bytes.NewReader([]byte{FileMessageOP, 0, 0, 0, 10, 1, 2}))
+
+	if err != io.ErrUnexpectedEOF {
+		t.Error("Truncated frame was not detected: ", err)
+	}
+
+	var buf bytes.Buffer
+
+	WriteFrame(&buf, 0xff, &light.ShareMessage{
+		ShareName: proto.String("test"),
+		Action:    light.ShareAction_ENTERING.Enum(),
+	})
+
+	if _, err = ReadMessage(&buf); err == nil {
+		t.Error("Unknown opcode was accepted")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	initLog()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	done := make(chan error)
+
+	go func() {
+		conn, err := ln.Accept()
+
+		if err == nil {
+			defer conn.Close()
+			_, err = ClientHandshake(conn)
+		}
+
+		done <- err
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	hello, err := ClientHandshake(conn)
+
+	if err != nil {
+		t.Fatal("Handshake failed: ", err)
+	}
+
+	if err = <-done; err != nil {
+		t.Fatal("Handshake failed on the accepting side: ", err)
+	}
+
+	if !CommonFeatures(hello)[FeatureDeltaSync] {
+		t.Error("Delta sync should be enabled between two identical nodes")
+	}
+
+	var buf bytes.Buffer
+
+	WriteFrame(&buf, HelloOP, &light.Hello{
+		ProtocolVersion: proto.Uint32(MinProtocolVersion - 1),
+		NodeName:        proto.String("ancient"),
+	})
+
+	peer := struct {
+		io.Reader
+		io.Writer
+	}{&buf, &bytes.Buffer{}}
+
+	if _, err = ClientHandshake(peer); err == nil {
+		t.Error("Incompatible protocol version was accepted")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"os"
+	"time"
+)
+
+/**
+ * Permission bits of the file described by info as stored in the index.
+ * Setuid and setgid bits are left out, they are not taken from peers
+ **/
+func fileMode(info os.FileInfo) uint32 {
+	return uint32(info.Mode().Perm())
+}
+
+/**
+ * Owners are only synced when asked to and when we are allowed to change them
+ **/
+func (s *Share) SyncsOwnership() bool {
+	return s.Config.SyncOwnership && os.Geteuid() == 0
+}
+
+/**
+ * Tells whether the metadata of the file described by stat differs from the
+ * one recorded in entry. Entries indexed before modes were recorded have
+ * none and only get it, the same way symlinks never have any
+ **/
+func (s *Share) metadataChanged(entry *FileEntry, stat os.FileInfo) bool {
+	if !entry.HasMode || isSymlink(stat) {
+		return false
+	}
+
+	if entry.Mode != fileMode(stat) {
+		return true
+	}
+
+	uid, gid := fileOwner(stat)
+
+	if s.SyncsOwnership() && (entry.Uid != uid || entry.Gid != gid) {
+		return true
+	}
+
+	return s.Config.SyncXattrs &&
+		encodeXattrs(entry.Xattrs) != encodeXattrs(s.readXattrs(entry.Path, stat))
+}
+
+/**
+ * Tells whether the metadata of remote, the entry of a peer, matches ours.
+ * Peers not sending any always match
+ **/
+func (s *Share) sameMetadata(local, remote *FileEntry) bool {
+	if !remote.HasMode || local.Target != "" {
+		return true
+	}
+
+	if local.Mode != remote.Mode || !s.sameXattrs(local.Xattrs, remote.Xattrs) {
+		return false
+	}
+
+	return !s.SyncsOwnership() || (local.Uid == remote.Uid && local.Gid == remote.Gid)
+}
+
+/**
+ * Gives file the permission bits, owner, extended attributes and
+ * modification time meta has, once its content was written. Symlinks are
+ * left untouched as changing them would change the file they point to
+ **/
+func (s *Share) ApplyMetadata(file string, meta *FileEntry) (err error) {
+	full, err := s.parentPath(file)
+
+	if err != nil {
+		return
+	}
+
+	stat, err := os.Lstat(full)
+
+	if err != nil || isSymlink(stat) {
+		return
+	}
+
+	if meta.HasMode {
+		err = os.Chmod(full, os.FileMode(meta.Mode).Perm())
+
+		if err != nil {
+			return
+		}
+	}
+
+	if meta.HasMode && s.SyncsOwnership() {
+		err = os.Lchown(full, int(meta.Uid), int(meta.Gid))
+
+		if err != nil {
+			return
+		}
+	}
+
+	err = s.applyXattrs(full, meta)
+
+	if err != nil {
+		return
+	}
+
+	if meta.ModTime != 0 && !stat.IsDir() {
+		mtime := time.Unix(meta.ModTime, 0)
+		err = os.Chtimes(full, mtime, mtime)
+	}
+
+	return
+}
+
+/**
+ * Metadata of the file described by e as sent to peers
+ **/
+func metadataToProto(e *FileEntry) (mode, uid, gid *uint32) {
+	if !e.HasMode {
+		return nil, nil, nil
+	}
+
+	return proto.Uint32(e.Mode), proto.Uint32(e.Uid), proto.Uint32(e.Gid)
+}
+
+/**
+ * Called when peer has the same content as ours for file, only the versions
+ * and metadata may differ. Metadata changes are versioned like the content:
+ * the newer one is applied and a concurrent one decided like a conflict,
+ * except that no copy is kept
+ **/
+func (sh *ShareHandler) reconcileMetadata(peer *Client, local, remote *FileEntry) {
+	file := local.Path
+	order := remote.Vector.Compare(local.Vector)
+
+	switch {
+	case order == VersionEqual:
+		return
+
+	case sh.sameMetadata(local, remote):
+		//Just make sure we know about every change to it
+		local.Vector = local.Vector.Merge(remote.Vector)
+		sh.StoreEntry(local)
+
+	case order == VersionOlder:
+		LogObj.Println("Ignoring outdated metadata of", file, "from", peer.Name())
+
+	case order == VersionNewer || sh.RemoteWins(local, remote.ModTime, peer.Name()):
+		sh.ExpectFile(file, local.Hash)
+
+		err := sh.ApplyMetadata(file, remote)
+
+		if err != nil {
+			LogObj.Println("Could not apply metadata of", file, ":", err)
+			return
+		}
+
+		_, err = sh.IndexFile(file, remote.Vector)
+
+		if err != nil {
+			LogObj.Println("Could not index", file, ":", err)
+		}
+
+	default:
+		//Ours wins, announced with a version newer than both
+		local.Vector = local.Vector.Merge(remote.Vector).Increment(LocalFingerprint)
+
+		if sh.StoreEntry(local) == nil {
+			sh.Announce(local)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestApplyMetadata(t *testing.T) {
+	s, cleanup := TempShare(t)
+	defer cleanup()
+
+	root := s.Path
+
+	full := path.Join(root, "script.sh")
+	ioutil.WriteFile(full, []byte("#!/bin/sh\n"), 0644)
+
+	mtime := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC).Unix()
+
+	err := s.ApplyMetadata("script.sh", &FileEntry{Mode: 0755, HasMode: true,
+		ModTime: mtime})
+
+	if err != nil {
+		t.Fatal("Could not apply metadata: ", err)
+	}
+
+	stat, err := os.Stat(full)
+
+	if err != nil {
+		t.Fatal("Could not stat file: ", err)
+	}
+
+	if stat.Mode().Perm() != 0755 {
+		t.Error("Mode not applied:", stat.Mode())
+	}
+
+	if stat.ModTime().Unix() != mtime {
+		t.Error("Modification time not applied:", stat.ModTime())
+	}
+
+	entry := &FileEntry{Mode: 0644, HasMode: true}
+
+	if !s.metadataChanged(entry, stat) {
+		t.Error("Mode change not detected")
+	}
+
+	entry.HasMode = false
+
+	if s.metadataChanged(entry, stat) {
+		t.Error("Entry without mode reported as changed")
+	}
+}
+
+func TestSameMetadata(t *testing.T) {
+	s := &Share{}
+	local := &FileEntry{Mode: 0644, HasMode: true, Uid: 1000, Gid: 1000}
+
+	if !s.sameMetadata(local, &FileEntry{}) {
+		t.Error("Peer sending no metadata differs")
+	}
+
+	if s.sameMetadata(local, &FileEntry{Mode: 0755, HasMode: true, Uid: 1000,
+		Gid: 1000}) {
+		t.Error("Mode change not detected")
+	}
+
+	//Ownership is not synced by default
+	if !s.sameMetadata(local, &FileEntry{Mode: 0644, HasMode: true, Uid: 0,
+		Gid: 0}) {
+		t.Error("Owner compared while not synced")
+	}
+}
+
+func TestEmptyMode(t *testing.T) {
+	s, cleanup := TempIndexedShare(t)
+	defer cleanup()
+
+	full := path.Join(s.Path, "locked")
+	ioutil.WriteFile(full, []byte("secret\n"), 0644)
+
+	if _, err := s.CheckFileDeep("locked"); err != nil {
+		t.Fatal("Could not index file: ", err)
+	}
+
+	os.Chmod(full, 0)
+
+	if modified, err := s.CheckFileShallow("locked"); err != nil || !modified {
+		t.Fatal("Change to mode 000 not detected: ", err)
+	}
+
+	entry, err := s.StoredEntry("locked")
+
+	if err != nil {
+		t.Fatal("Could not read entry: ", err)
+	}
+
+	//Recorded the way hashing the file again would
+	entry.Mode = 0
+	err = s.StoreEntry(entry)
+
+	if err != nil {
+		t.Fatal("Could not store entry: ", err)
+	}
+
+	entry, err = s.StoredEntry("locked")
+
+	if err != nil || !entry.HasMode || entry.Mode != 0 {
+		t.Fatal("Mode 000 not stored: ", entry, err)
+	}
+
+	if modified, err := s.CheckFileShallow("locked"); err != nil || modified {
+		t.Error("File with mode 000 reported as modified: ", err)
+	}
+
+	remote := entryFromProto(entryToProto(entry))
+
+	if !remote.HasMode || remote.Mode != 0 {
+		t.Error("Mode 000 not sent to peers: ", remote)
+	}
+}
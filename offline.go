@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+/**
+ * Changes made to a share while we were not running, the entries being the
+ * ones stored in the index once the changes were recorded
+ **/
+type OfflineReport struct {
+	Created  []*FileEntry
+	Modified []*FileEntry
+	Removed  []*FileEntry
+}
+
+func (r *OfflineReport) Len() int {
+	return len(r.Created) + len(r.Modified) + len(r.Removed)
+}
+
+/**
+ * Compares the whole share with the index, recording the files created,
+ * modified and removed since we last ran, then starts watching it
+ **/
+func (s *Share) FromOffline() (report *OfflineReport, err error) {
+	stat, err := os.Stat(s.Path)
+
+	if err != nil || !stat.IsDir() {
+		return nil, errors.New("Invalid share path: " + s.Path + "!")
+	}
+
+	report = &OfflineReport{}
+
+	err = filepath.Walk(s.Path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			LogObj.Println("Could not read", p, ":", err)
+			return nil
+		}
+
+		file, ignored := s.walkedPath(p, info)
+
+		if ignored {
+			return skipEntry(info)
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		before, err := s.StoredEntry(file)
+
+		if err != nil {
+			return err
+		}
+
+		entry := s.recordChange(file)
+
+		if entry == nil {
+			return nil
+		}
+
+		if before == nil || before.Deleted {
+			report.Created = append(report.Created, entry)
+		} else {
+			report.Modified = append(report.Modified, entry)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	var indexed []string
+
+	err = s.ForEachEntry(0, func(e *FileEntry) error {
+		if !e.Deleted && !s.Ignored(e.Path, false) {
+			indexed = append(indexed, e.Path)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	for _, f := range indexed {
+		if _, err := os.Lstat(path.Join(s.Path, f)); !os.IsNotExist(err) {
+			continue
+		}
+
+		if entry := s.recordChange(f); entry != nil {
+			report.Removed = append(report.Removed, entry)
+		}
+	}
+
+	err = s.Watch(s.Path)
+
+	if err != nil {
+		LogObj.Println("Could not watch share", s.Name, ":", err)
+		err = nil
+	}
+
+	return
+}
+
+/**
+ * Records the changes made to file and returns its new entry, nil if it did
+ * not change or could not be read
+ **/
+func (s *Share) recordChange(file string) *FileEntry {
+	modified, err := s.CheckFileShallow(file)
+
+	if err == nil && modified {
+		modified, err = s.CheckFileDeep(file)
+	}
+
+	if err != nil {
+		LogObj.Println("Could not index", file, ":", err)
+		return nil
+	}
+
+	if !modified {
+		return nil
+	}
+
+	entry, err := s.StoredEntry(file)
+
+	if err != nil {
+		LogObj.Println("Could not read index entry of", file, ":", err)
+		return nil
+	}
+
+	return entry
+}
+
+/**
+ * Tells the clients of the share about the changes found at startup
+ **/
+func (sh *ShareHandler) AnnounceReport(report *OfflineReport) {
+	for _, entries := range [][]*FileEntry{
+		report.Created, report.Modified, report.Removed} {
+		for _, e := range entries {
+			sh.Announce(e)
+		}
+	}
+}
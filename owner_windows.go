@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+/**
+ * Windows files have no Unix owner, ownership is never synced there
+ **/
+func fileOwner(info os.FileInfo) (uid, gid uint32) {
+	return 0, 0
+}
@@ -9,9 +9,23 @@ It is generated from these files:
 	light.proto
 
 It has these top-level messages:
+	Hello
 	ShareMessage
 	PeerMessage
+	VersionCounter
+	Xattr
+	XattrSet
 	FileMessage
+	BlockList
+	ChunkRequest
+	ChunkData
+	DeltaRequest
+	DeltaOp
+	DeltaData
+	IndexEntry
+	IndexMessage
+	TreeNode
+	TreeMessage
 */
 package light
 
@@ -61,17 +75,20 @@ const (
 	FileAction_CREATED FileAction = 0
 	FileAction_UPDATED FileAction = 1
 	FileAction_REMOVED FileAction = 2
+	FileAction_RENAMED FileAction = 3
 )
 
 var FileAction_name = map[int32]string{
 	0: "CREATED",
 	1: "UPDATED",
 	2: "REMOVED",
+	3: "RENAMED",
 }
 var FileAction_value = map[string]int32{
 	"CREATED": 0,
 	"UPDATED": 1,
 	"REMOVED": 2,
+	"RENAMED": 3,
 }
 
 func (x FileAction) Enum() *FileAction {
@@ -91,9 +108,76 @@ func (x *FileAction) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type FileType int32
+
+const (
+	FileType_REGULAR FileType = 0
+	FileType_SYMLINK FileType = 1
+)
+
+var FileType_name = map[int32]string{
+	0: "REGULAR",
+	1: "SYMLINK",
+}
+var FileType_value = map[string]int32{
+	"REGULAR": 0,
+	"SYMLINK": 1,
+}
+
+func (x FileType) Enum() *FileType {
+	p := new(FileType)
+	*p = x
+	return p
+}
+func (x FileType) String() string {
+	return proto.EnumName(FileType_name, int32(x))
+}
+func (x *FileType) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(FileType_value, data, "FileType")
+	if err != nil {
+		return err
+	}
+	*x = FileType(value)
+	return nil
+}
+
+type Hello struct {
+	ProtocolVersion  *uint32  `protobuf:"varint,1,req,name=protocol_version" json:"protocol_version,omitempty"`
+	NodeName         *string  `protobuf:"bytes,2,req,name=node_name" json:"node_name,omitempty"`
+	Features         []string `protobuf:"bytes,3,rep,name=features" json:"features,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Hello) Reset()         { *m = Hello{} }
+func (m *Hello) String() string { return proto.CompactTextString(m) }
+func (*Hello) ProtoMessage()    {}
+
+func (m *Hello) GetProtocolVersion() uint32 {
+	if m != nil && m.ProtocolVersion != nil {
+		return *m.ProtocolVersion
+	}
+	return 0
+}
+
+func (m *Hello) GetNodeName() string {
+	if m != nil && m.NodeName != nil {
+		return *m.NodeName
+	}
+	return ""
+}
+
+func (m *Hello) GetFeatures() []string {
+	if m != nil {
+		return m.Features
+	}
+	return nil
+}
+
 type ShareMessage struct {
 	ShareName        *string      `protobuf:"bytes,1,req,name=share_name" json:"share_name,omitempty"`
 	Action           *ShareAction `protobuf:"varint,2,req,name=action,enum=light.ShareAction" json:"action,omitempty"`
+	IndexId          *string      `protobuf:"bytes,3,opt,name=index_id" json:"index_id,omitempty"`
+	Since            *int64       `protobuf:"varint,4,opt,name=since" json:"since,omitempty"`
 	XXX_unrecognized []byte       `json:"-"`
 }
 
@@ -115,6 +199,20 @@ func (m *ShareMessage) GetAction() ShareAction {
 	return ShareAction_ENTERING
 }
 
+func (m *ShareMessage) GetIndexId() string {
+	if m != nil && m.IndexId != nil {
+		return *m.IndexId
+	}
+	return ""
+}
+
+func (m *ShareMessage) GetSince() int64 {
+	if m != nil && m.Since != nil {
+		return *m.Since
+	}
+	return 0
+}
+
 type PeerMessage struct {
 	PeerName         *string  `protobuf:"bytes,1,req,name=peer_name" json:"peer_name,omitempty"`
 	Address          *string  `protobuf:"bytes,2,req,name=address" json:"address,omitempty"`
@@ -155,12 +253,86 @@ func (m *PeerMessage) GetShares() []string {
 	return nil
 }
 
+type VersionCounter struct {
+	Id               *string `protobuf:"bytes,1,req,name=id" json:"id,omitempty"`
+	Value            *uint64 `protobuf:"varint,2,req,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *VersionCounter) Reset()         { *m = VersionCounter{} }
+func (m *VersionCounter) String() string { return proto.CompactTextString(m) }
+func (*VersionCounter) ProtoMessage()    {}
+
+func (m *VersionCounter) GetId() string {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return ""
+}
+
+func (m *VersionCounter) GetValue() uint64 {
+	if m != nil && m.Value != nil {
+		return *m.Value
+	}
+	return 0
+}
+
+type Xattr struct {
+	Name             *string `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
+	Value            []byte  `protobuf:"bytes,2,req,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Xattr) Reset()         { *m = Xattr{} }
+func (m *Xattr) String() string { return proto.CompactTextString(m) }
+func (*Xattr) ProtoMessage()    {}
+
+func (m *Xattr) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *Xattr) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+type XattrSet struct {
+	Attrs            []*Xattr `protobuf:"bytes,1,rep,name=attrs" json:"attrs,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *XattrSet) Reset()         { *m = XattrSet{} }
+func (m *XattrSet) String() string { return proto.CompactTextString(m) }
+func (*XattrSet) ProtoMessage()    {}
+
+func (m *XattrSet) GetAttrs() []*Xattr {
+	if m != nil {
+		return m.Attrs
+	}
+	return nil
+}
+
 type FileMessage struct {
-	Filename         *string     `protobuf:"bytes,1,req,name=filename" json:"filename,omitempty"`
-	Folder           *bool       `protobuf:"varint,2,req,name=folder" json:"folder,omitempty"`
-	Action           *FileAction `protobuf:"varint,3,req,name=action,enum=light.FileAction" json:"action,omitempty"`
-	Hash             []byte      `protobuf:"bytes,4,opt,name=hash" json:"hash,omitempty"`
-	XXX_unrecognized []byte      `json:"-"`
+	Filename         *string           `protobuf:"bytes,1,req,name=filename" json:"filename,omitempty"`
+	ShareName        *string           `protobuf:"bytes,2,req,name=share_name" json:"share_name,omitempty"`
+	Folder           *bool             `protobuf:"varint,3,req,name=folder" json:"folder,omitempty"`
+	Action           *FileAction       `protobuf:"varint,4,req,name=action,enum=light.FileAction" json:"action,omitempty"`
+	Hash             []byte            `protobuf:"bytes,5,opt,name=hash" json:"hash,omitempty"`
+	Version          []*VersionCounter `protobuf:"bytes,6,rep,name=version" json:"version,omitempty"`
+	Mtime            *int64            `protobuf:"varint,7,opt,name=mtime" json:"mtime,omitempty"`
+	OldFilename      *string           `protobuf:"bytes,8,opt,name=old_filename" json:"old_filename,omitempty"`
+	Type             *FileType         `protobuf:"varint,9,opt,name=type,enum=light.FileType" json:"type,omitempty"`
+	Target           *string           `protobuf:"bytes,10,opt,name=target" json:"target,omitempty"`
+	Mode             *uint32           `protobuf:"varint,11,opt,name=mode" json:"mode,omitempty"`
+	Uid              *uint32           `protobuf:"varint,12,opt,name=uid" json:"uid,omitempty"`
+	Gid              *uint32           `protobuf:"varint,13,opt,name=gid" json:"gid,omitempty"`
+	Xattrs           *XattrSet         `protobuf:"bytes,14,opt,name=xattrs" json:"xattrs,omitempty"`
+	XXX_unrecognized []byte            `json:"-"`
 }
 
 func (m *FileMessage) Reset()         { *m = FileMessage{} }
@@ -174,6 +346,13 @@ func (m *FileMessage) GetFilename() string {
 	return ""
 }
 
+func (m *FileMessage) GetShareName() string {
+	if m != nil && m.ShareName != nil {
+		return *m.ShareName
+	}
+	return ""
+}
+
 func (m *FileMessage) GetFolder() bool {
 	if m != nil && m.Folder != nil {
 		return *m.Folder
@@ -195,7 +374,567 @@ func (m *FileMessage) GetHash() []byte {
 	return nil
 }
 
+func (m *FileMessage) GetVersion() []*VersionCounter {
+	if m != nil {
+		return m.Version
+	}
+	return nil
+}
+
+func (m *FileMessage) GetMtime() int64 {
+	if m != nil && m.Mtime != nil {
+		return *m.Mtime
+	}
+	return 0
+}
+
+func (m *FileMessage) GetOldFilename() string {
+	if m != nil && m.OldFilename != nil {
+		return *m.OldFilename
+	}
+	return ""
+}
+
+func (m *FileMessage) GetType() FileType {
+	if m != nil && m.Type != nil {
+		return *m.Type
+	}
+	return FileType_REGULAR
+}
+
+func (m *FileMessage) GetTarget() string {
+	if m != nil && m.Target != nil {
+		return *m.Target
+	}
+	return ""
+}
+
+func (m *FileMessage) GetMode() uint32 {
+	if m != nil && m.Mode != nil {
+		return *m.Mode
+	}
+	return 0
+}
+
+func (m *FileMessage) GetUid() uint32 {
+	if m != nil && m.Uid != nil {
+		return *m.Uid
+	}
+	return 0
+}
+
+func (m *FileMessage) GetGid() uint32 {
+	if m != nil && m.Gid != nil {
+		return *m.Gid
+	}
+	return 0
+}
+
+func (m *FileMessage) GetXattrs() *XattrSet {
+	if m != nil {
+		return m.Xattrs
+	}
+	return nil
+}
+
+type BlockList struct {
+	Filename         *string  `protobuf:"bytes,1,req,name=filename" json:"filename,omitempty"`
+	ShareName        *string  `protobuf:"bytes,2,req,name=share_name" json:"share_name,omitempty"`
+	Hash             []byte   `protobuf:"bytes,3,req,name=hash" json:"hash,omitempty"`
+	Size             *int64   `protobuf:"varint,4,req,name=size" json:"size,omitempty"`
+	Blocks           [][]byte `protobuf:"bytes,5,rep,name=blocks" json:"blocks,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *BlockList) Reset()         { *m = BlockList{} }
+func (m *BlockList) String() string { return proto.CompactTextString(m) }
+func (*BlockList) ProtoMessage()    {}
+
+func (m *BlockList) GetFilename() string {
+	if m != nil && m.Filename != nil {
+		return *m.Filename
+	}
+	return ""
+}
+
+func (m *BlockList) GetShareName() string {
+	if m != nil && m.ShareName != nil {
+		return *m.ShareName
+	}
+	return ""
+}
+
+func (m *BlockList) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *BlockList) GetSize() int64 {
+	if m != nil && m.Size != nil {
+		return *m.Size
+	}
+	return 0
+}
+
+func (m *BlockList) GetBlocks() [][]byte {
+	if m != nil {
+		return m.Blocks
+	}
+	return nil
+}
+
+type ChunkRequest struct {
+	Filename         *string `protobuf:"bytes,1,req,name=filename" json:"filename,omitempty"`
+	ShareName        *string `protobuf:"bytes,2,req,name=share_name" json:"share_name,omitempty"`
+	Hash             []byte  `protobuf:"bytes,3,opt,name=hash" json:"hash,omitempty"`
+	Chunks           []int64 `protobuf:"varint,4,rep,name=chunks" json:"chunks,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ChunkRequest) Reset()         { *m = ChunkRequest{} }
+func (m *ChunkRequest) String() string { return proto.CompactTextString(m) }
+func (*ChunkRequest) ProtoMessage()    {}
+
+func (m *ChunkRequest) GetFilename() string {
+	if m != nil && m.Filename != nil {
+		return *m.Filename
+	}
+	return ""
+}
+
+func (m *ChunkRequest) GetShareName() string {
+	if m != nil && m.ShareName != nil {
+		return *m.ShareName
+	}
+	return ""
+}
+
+func (m *ChunkRequest) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *ChunkRequest) GetChunks() []int64 {
+	if m != nil {
+		return m.Chunks
+	}
+	return nil
+}
+
+type ChunkData struct {
+	Filename         *string `protobuf:"bytes,1,req,name=filename" json:"filename,omitempty"`
+	ShareName        *string `protobuf:"bytes,2,req,name=share_name" json:"share_name,omitempty"`
+	Hash             []byte  `protobuf:"bytes,3,req,name=hash" json:"hash,omitempty"`
+	Chunk            *int64  `protobuf:"varint,4,req,name=chunk" json:"chunk,omitempty"`
+	Data             []byte  `protobuf:"bytes,5,req,name=data" json:"data,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ChunkData) Reset()         { *m = ChunkData{} }
+func (m *ChunkData) String() string { return proto.CompactTextString(m) }
+func (*ChunkData) ProtoMessage()    {}
+
+func (m *ChunkData) GetFilename() string {
+	if m != nil && m.Filename != nil {
+		return *m.Filename
+	}
+	return ""
+}
+
+func (m *ChunkData) GetShareName() string {
+	if m != nil && m.ShareName != nil {
+		return *m.ShareName
+	}
+	return ""
+}
+
+func (m *ChunkData) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *ChunkData) GetChunk() int64 {
+	if m != nil && m.Chunk != nil {
+		return *m.Chunk
+	}
+	return 0
+}
+
+func (m *ChunkData) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+type DeltaRequest struct {
+	Filename         *string  `protobuf:"bytes,1,req,name=filename" json:"filename,omitempty"`
+	ShareName        *string  `protobuf:"bytes,2,req,name=share_name" json:"share_name,omitempty"`
+	Hash             []byte   `protobuf:"bytes,3,opt,name=hash" json:"hash,omitempty"`
+	BlockSize        *int32   `protobuf:"varint,4,req,name=block_size" json:"block_size,omitempty"`
+	Weak             []uint32 `protobuf:"varint,5,rep,name=weak" json:"weak,omitempty"`
+	Strong           [][]byte `protobuf:"bytes,6,rep,name=strong" json:"strong,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *DeltaRequest) Reset()         { *m = DeltaRequest{} }
+func (m *DeltaRequest) String() string { return proto.CompactTextString(m) }
+func (*DeltaRequest) ProtoMessage()    {}
+
+func (m *DeltaRequest) GetFilename() string {
+	if m != nil && m.Filename != nil {
+		return *m.Filename
+	}
+	return ""
+}
+
+func (m *DeltaRequest) GetShareName() string {
+	if m != nil && m.ShareName != nil {
+		return *m.ShareName
+	}
+	return ""
+}
+
+func (m *DeltaRequest) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *DeltaRequest) GetBlockSize() int32 {
+	if m != nil && m.BlockSize != nil {
+		return *m.BlockSize
+	}
+	return 0
+}
+
+func (m *DeltaRequest) GetWeak() []uint32 {
+	if m != nil {
+		return m.Weak
+	}
+	return nil
+}
+
+func (m *DeltaRequest) GetStrong() [][]byte {
+	if m != nil {
+		return m.Strong
+	}
+	return nil
+}
+
+type DeltaOp struct {
+	Block            *int64 `protobuf:"varint,1,opt,name=block" json:"block,omitempty"`
+	Literal          []byte `protobuf:"bytes,2,opt,name=literal" json:"literal,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *DeltaOp) Reset()         { *m = DeltaOp{} }
+func (m *DeltaOp) String() string { return proto.CompactTextString(m) }
+func (*DeltaOp) ProtoMessage()    {}
+
+func (m *DeltaOp) GetBlock() int64 {
+	if m != nil && m.Block != nil {
+		return *m.Block
+	}
+	return 0
+}
+
+func (m *DeltaOp) GetLiteral() []byte {
+	if m != nil {
+		return m.Literal
+	}
+	return nil
+}
+
+type DeltaData struct {
+	Filename         *string    `protobuf:"bytes,1,req,name=filename" json:"filename,omitempty"`
+	ShareName        *string    `protobuf:"bytes,2,req,name=share_name" json:"share_name,omitempty"`
+	Hash             []byte     `protobuf:"bytes,3,req,name=hash" json:"hash,omitempty"`
+	Ops              []*DeltaOp `protobuf:"bytes,4,rep,name=ops" json:"ops,omitempty"`
+	Last             *bool      `protobuf:"varint,5,opt,name=last" json:"last,omitempty"`
+	XXX_unrecognized []byte     `json:"-"`
+}
+
+func (m *DeltaData) Reset()         { *m = DeltaData{} }
+func (m *DeltaData) String() string { return proto.CompactTextString(m) }
+func (*DeltaData) ProtoMessage()    {}
+
+func (m *DeltaData) GetFilename() string {
+	if m != nil && m.Filename != nil {
+		return *m.Filename
+	}
+	return ""
+}
+
+func (m *DeltaData) GetShareName() string {
+	if m != nil && m.ShareName != nil {
+		return *m.ShareName
+	}
+	return ""
+}
+
+func (m *DeltaData) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *DeltaData) GetOps() []*DeltaOp {
+	if m != nil {
+		return m.Ops
+	}
+	return nil
+}
+
+func (m *DeltaData) GetLast() bool {
+	if m != nil && m.Last != nil {
+		return *m.Last
+	}
+	return false
+}
+
+type IndexEntry struct {
+	Filename         *string           `protobuf:"bytes,1,req,name=filename" json:"filename,omitempty"`
+	Hash             []byte            `protobuf:"bytes,2,opt,name=hash" json:"hash,omitempty"`
+	Size             *int64            `protobuf:"varint,3,opt,name=size" json:"size,omitempty"`
+	Mtime            *int64            `protobuf:"varint,4,opt,name=mtime" json:"mtime,omitempty"`
+	Version          []*VersionCounter `protobuf:"bytes,5,rep,name=version" json:"version,omitempty"`
+	Deleted          *bool             `protobuf:"varint,6,opt,name=deleted" json:"deleted,omitempty"`
+	Type             *FileType         `protobuf:"varint,7,opt,name=type,enum=light.FileType" json:"type,omitempty"`
+	Target           *string           `protobuf:"bytes,8,opt,name=target" json:"target,omitempty"`
+	Mode             *uint32           `protobuf:"varint,9,opt,name=mode" json:"mode,omitempty"`
+	Uid              *uint32           `protobuf:"varint,10,opt,name=uid" json:"uid,omitempty"`
+	Gid              *uint32           `protobuf:"varint,11,opt,name=gid" json:"gid,omitempty"`
+	Xattrs           *XattrSet         `protobuf:"bytes,12,opt,name=xattrs" json:"xattrs,omitempty"`
+	XXX_unrecognized []byte            `json:"-"`
+}
+
+func (m *IndexEntry) Reset()         { *m = IndexEntry{} }
+func (m *IndexEntry) String() string { return proto.CompactTextString(m) }
+func (*IndexEntry) ProtoMessage()    {}
+
+func (m *IndexEntry) GetFilename() string {
+	if m != nil && m.Filename != nil {
+		return *m.Filename
+	}
+	return ""
+}
+
+func (m *IndexEntry) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *IndexEntry) GetSize() int64 {
+	if m != nil && m.Size != nil {
+		return *m.Size
+	}
+	return 0
+}
+
+func (m *IndexEntry) GetMtime() int64 {
+	if m != nil && m.Mtime != nil {
+		return *m.Mtime
+	}
+	return 0
+}
+
+func (m *IndexEntry) GetVersion() []*VersionCounter {
+	if m != nil {
+		return m.Version
+	}
+	return nil
+}
+
+func (m *IndexEntry) GetDeleted() bool {
+	if m != nil && m.Deleted != nil {
+		return *m.Deleted
+	}
+	return false
+}
+
+func (m *IndexEntry) GetType() FileType {
+	if m != nil && m.Type != nil {
+		return *m.Type
+	}
+	return FileType_REGULAR
+}
+
+func (m *IndexEntry) GetTarget() string {
+	if m != nil && m.Target != nil {
+		return *m.Target
+	}
+	return ""
+}
+
+func (m *IndexEntry) GetMode() uint32 {
+	if m != nil && m.Mode != nil {
+		return *m.Mode
+	}
+	return 0
+}
+
+func (m *IndexEntry) GetUid() uint32 {
+	if m != nil && m.Uid != nil {
+		return *m.Uid
+	}
+	return 0
+}
+
+func (m *IndexEntry) GetGid() uint32 {
+	if m != nil && m.Gid != nil {
+		return *m.Gid
+	}
+	return 0
+}
+
+func (m *IndexEntry) GetXattrs() *XattrSet {
+	if m != nil {
+		return m.Xattrs
+	}
+	return nil
+}
+
+type IndexMessage struct {
+	ShareName        *string       `protobuf:"bytes,1,req,name=share_name" json:"share_name,omitempty"`
+	Files            []*IndexEntry `protobuf:"bytes,2,rep,name=files" json:"files,omitempty"`
+	Last             *bool         `protobuf:"varint,3,opt,name=last" json:"last,omitempty"`
+	IndexId          *string       `protobuf:"bytes,4,opt,name=index_id" json:"index_id,omitempty"`
+	Sequence         *int64        `protobuf:"varint,5,opt,name=sequence" json:"sequence,omitempty"`
+	XXX_unrecognized []byte        `json:"-"`
+}
+
+func (m *IndexMessage) Reset()         { *m = IndexMessage{} }
+func (m *IndexMessage) String() string { return proto.CompactTextString(m) }
+func (*IndexMessage) ProtoMessage()    {}
+
+func (m *IndexMessage) GetShareName() string {
+	if m != nil && m.ShareName != nil {
+		return *m.ShareName
+	}
+	return ""
+}
+
+func (m *IndexMessage) GetFiles() []*IndexEntry {
+	if m != nil {
+		return m.Files
+	}
+	return nil
+}
+
+func (m *IndexMessage) GetLast() bool {
+	if m != nil && m.Last != nil {
+		return *m.Last
+	}
+	return false
+}
+
+func (m *IndexMessage) GetIndexId() string {
+	if m != nil && m.IndexId != nil {
+		return *m.IndexId
+	}
+	return ""
+}
+
+func (m *IndexMessage) GetSequence() int64 {
+	if m != nil && m.Sequence != nil {
+		return *m.Sequence
+	}
+	return 0
+}
+
+type TreeNode struct {
+	Path             *string `protobuf:"bytes,1,req,name=path" json:"path,omitempty"`
+	Folder           *bool   `protobuf:"varint,2,req,name=folder" json:"folder,omitempty"`
+	Hash             []byte  `protobuf:"bytes,3,opt,name=hash" json:"hash,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *TreeNode) Reset()         { *m = TreeNode{} }
+func (m *TreeNode) String() string { return proto.CompactTextString(m) }
+func (*TreeNode) ProtoMessage()    {}
+
+func (m *TreeNode) GetPath() string {
+	if m != nil && m.Path != nil {
+		return *m.Path
+	}
+	return ""
+}
+
+func (m *TreeNode) GetFolder() bool {
+	if m != nil && m.Folder != nil {
+		return *m.Folder
+	}
+	return false
+}
+
+func (m *TreeNode) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+type TreeMessage struct {
+	ShareName        *string     `protobuf:"bytes,1,req,name=share_name" json:"share_name,omitempty"`
+	Path             *string     `protobuf:"bytes,2,req,name=path" json:"path,omitempty"`
+	Hash             []byte      `protobuf:"bytes,3,opt,name=hash" json:"hash,omitempty"`
+	Children         []*TreeNode `protobuf:"bytes,4,rep,name=children" json:"children,omitempty"`
+	Reply            *bool       `protobuf:"varint,5,opt,name=reply" json:"reply,omitempty"`
+	XXX_unrecognized []byte      `json:"-"`
+}
+
+func (m *TreeMessage) Reset()         { *m = TreeMessage{} }
+func (m *TreeMessage) String() string { return proto.CompactTextString(m) }
+func (*TreeMessage) ProtoMessage()    {}
+
+func (m *TreeMessage) GetShareName() string {
+	if m != nil && m.ShareName != nil {
+		return *m.ShareName
+	}
+	return ""
+}
+
+func (m *TreeMessage) GetPath() string {
+	if m != nil && m.Path != nil {
+		return *m.Path
+	}
+	return ""
+}
+
+func (m *TreeMessage) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *TreeMessage) GetChildren() []*TreeNode {
+	if m != nil {
+		return m.Children
+	}
+	return nil
+}
+
+func (m *TreeMessage) GetReply() bool {
+	if m != nil && m.Reply != nil {
+		return *m.Reply
+	}
+	return false
+}
+
 func init() {
 	proto.RegisterEnum("light.ShareAction", ShareAction_name, ShareAction_value)
 	proto.RegisterEnum("light.FileAction", FileAction_name, FileAction_value)
+	proto.RegisterEnum("light.FileType", FileType_name, FileType_value)
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	//Longest file name accepted from a peer, the limit of most file systems
+	maxNameLength int = 255
+
+	//Messages with paths leaving the share a peer may send before being dropped
+	maxPathViolations int = 3
+)
+
+var ErrInvalidPath = errors.New("Invalid path name!")
+var ErrPathTraversal = errors.New("Path points outside of the share!")
+var ErrSymlinkEscape = errors.New("Path resolves outside of the share through a symlink!")
+
+/**
+ * Checks that name, a path received from a peer, is a canonical path
+ * relative to the share root: slash separated, without empty, . or ..
+ * components and not inside the metadata folder
+ **/
+func CheckRemotePath(name string) error {
+	if name == "" || strings.ContainsAny(name, "\x00\\") {
+		return ErrInvalidPath
+	}
+
+	if strings.HasPrefix(name, "/") {
+		return ErrPathTraversal
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		switch {
+		case part == "..":
+			return ErrPathTraversal
+
+		case part == "" || part == "." || len(part) > maxNameLength:
+			return ErrInvalidPath
+		}
+	}
+
+	if isMetaPath(name) {
+		return ErrPathTraversal
+	}
+
+	return nil
+}
+
+/**
+ * Makes sure the part of full, a path below the share root, that exists does
+ * not resolve outside of the share
+ **/
+func (s *Share) resolveInside(full string) (err error) {
+	root, err := filepath.EvalSymlinks(s.Path)
+
+	if err != nil {
+		return
+	}
+
+	existing := full
+
+	for {
+		_, err = os.Lstat(existing)
+
+		if err == nil {
+			break
+		}
+
+		if !os.IsNotExist(err) || existing == s.Path {
+			return
+		}
+
+		existing = path.Dir(existing)
+	}
+
+	//Fails on dangling links, which would be followed when writing
+	real, err := filepath.EvalSymlinks(existing)
+
+	if err != nil {
+		return
+	}
+
+	rel, err := filepath.Rel(root, real)
+
+	if err != nil {
+		return
+	}
+
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return ErrSymlinkEscape
+	}
+
+	return nil
+}
+
+/**
+ * Returns the full path of file, a path received from a peer, once checked.
+ * If file is a symlink it must point inside the share as it is followed
+ **/
+func (s *Share) SharePath(file string) (full string, err error) {
+	full, err = s.parentPath(file)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = s.resolveInside(full)
+
+	if err != nil {
+		return "", err
+	}
+
+	return
+}
+
+/**
+ * Same as SharePath for operations on file itself, which may then be a
+ * symlink pointing anywhere
+ **/
+func (s *Share) parentPath(file string) (full string, err error) {
+	err = CheckRemotePath(file)
+
+	if err != nil {
+		return
+	}
+
+	full = path.Join(s.Path, file)
+	err = s.resolveInside(path.Dir(full))
+
+	if err != nil {
+		return "", err
+	}
+
+	return
+}
+
+/**
+ * Lists the paths of the share carried by msg
+ **/
+func messagePaths(msg Message) (paths []string) {
+	switch m := msg.(type) {
+	case *FileMessageWrapper:
+		paths = append(paths, m.GetFilename())
+
+		if m.OldFilename != nil {
+			paths = append(paths, m.GetOldFilename())
+		}
+
+	case *BlockListWrapper:
+		paths = append(paths, m.GetFilename())
+
+	case *ChunkRequestWrapper:
+		paths = append(paths, m.GetFilename())
+
+	case *ChunkDataWrapper:
+		paths = append(paths, m.GetFilename())
+
+	case *DeltaRequestWrapper:
+		paths = append(paths, m.GetFilename())
+
+	case *DeltaDataWrapper:
+		paths = append(paths, m.GetFilename())
+
+	case *IndexMessageWrapper:
+		for _, f := range m.GetFiles() {
+			paths = append(paths, f.GetFilename())
+		}
+
+	case *TreeMessageWrapper:
+		if m.GetPath() != TreeRoot {
+			paths = append(paths, m.GetPath())
+		}
+
+		for _, n := range m.GetChildren() {
+			paths = append(paths, n.GetPath())
+		}
+	}
+
+	return
+}
+
+/**
+ * Checks the paths carried by msg before anything touches the disk, links
+ * being checked when the content of files is read or written. Messages with
+ * bad paths are dropped and peers sending paths leaving the share are
+ * dropped from it after a few of them
+ **/
+func (sh *ShareHandler) acceptPaths(msg Message) bool {
+	peer := msg.Sender()
+
+	if sh.violations[peer.Name()] >= maxPathViolations {
+		return false
+	}
+
+	for _, p := range messagePaths(msg) {
+		_, err := sh.parentPath(p)
+
+		if err == nil {
+			continue
+		}
+
+		LogObj.Printf("Dropping message from %s with path %q: %s", peer.Name(), p, err)
+
+		if err != ErrPathTraversal {
+			return false
+		}
+
+		sh.violations[peer.Name()]++
+
+		if sh.violations[peer.Name()] >= maxPathViolations {
+			LogObj.Println("Removing", peer.Name(), "from share", sh.Name,
+				"after", maxPathViolations, "paths leaving the share")
+			sh.SuspendTransfers(peer)
+			sh.RemoveClient(peer)
+		}
+
+		return false
+	}
+
+	return true
+}
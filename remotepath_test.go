@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCheckRemotePath(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+	}{
+		{"file.txt", nil},
+		{"dir/sub/file.txt", nil},
+		{"..file", nil},
+		{"../../.ssh/authorized_keys", ErrPathTraversal},
+		{"dir/../../file", ErrPathTraversal},
+		{"/etc/passwd", ErrPathTraversal},
+		{MetaDirName + "/index.db", ErrPathTraversal},
+		{"", ErrInvalidPath},
+		{"dir//file", ErrInvalidPath},
+		{"./file", ErrInvalidPath},
+		{"dir/", ErrInvalidPath},
+		{"..\\..\\file", ErrInvalidPath},
+		{"file\x00.txt", ErrInvalidPath},
+	}
+
+	for _, c := range cases {
+		if err := CheckRemotePath(c.name); err != c.err {
+			t.Errorf("CheckRemotePath(%q) = %v, expected %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestSymlinkEscape(t *testing.T) {
+	s, cleanup := TempShare(t)
+	defer cleanup()
+
+	root := s.Path
+
+	outside, err := ioutil.TempDir("", "lightsync")
+
+	if err != nil {
+		t.Fatal("Could not create test folder: ", err)
+	}
+
+	defer os.RemoveAll(outside)
+
+	os.Mkdir(path.Join(root, "dir"), 0755)
+	os.Symlink(outside, path.Join(root, "out"))
+	os.Symlink("dir", path.Join(root, "in"))
+	os.Symlink(path.Join(outside, "missing"), path.Join(root, "dangling"))
+
+	for _, file := range []string{"dir/file", "in/file", "new/folder/file"} {
+		if _, err := s.SharePath(file); err != nil {
+			t.Error("Rejected path", file, "inside the share: ", err)
+		}
+	}
+
+	for _, file := range []string{"out/file", "out", "dangling"} {
+		if _, err := s.SharePath(file); err == nil {
+			t.Error("Accepted path", file, "leaving the share")
+		}
+	}
+
+	//The links themselves can be replaced or removed
+	for _, file := range []string{"out", "dangling"} {
+		if _, err := s.parentPath(file); err != nil {
+			t.Error("Rejected link", file, "of the share: ", err)
+		}
+	}
+
+	ioutil.WriteFile(path.Join(root, "dir", "file"), []byte("content"), 0644)
+
+	if err := s.Move("dir/file", "out/file", nil); err == nil {
+		t.Error("Moved a file through a link leaving the share")
+	}
+
+	if err := s.Rename("../file", "dir/file"); err == nil {
+		t.Error("Renamed a file from outside the share")
+	}
+}
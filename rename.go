@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"lightsync/proto"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	//How long a removed file waits for the creation that would make it a rename
+	renameWindow time.Duration = 2 * time.Second
+)
+
+type pendingRemoval struct {
+	entry *FileEntry
+	at    time.Time
+}
+
+/**
+ * Pairs files disappearing from the share with the ones appearing shortly
+ * after so that renames are not handled as a removal and a creation
+ * Removals are kept for renameWindow before being considered real ones
+ **/
+type renameDetector struct {
+	pending map[string]*pendingRemoval
+	folders map[string]time.Time //Removed folders, announced after their files
+}
+
+func newRenameDetector() *renameDetector {
+	return &renameDetector{
+		pending: make(map[string]*pendingRemoval),
+		folders: make(map[string]time.Time),
+	}
+}
+
+/**
+ * Remembers that the file described by entry disappeared
+ **/
+func (d *renameDetector) Removed(entry *FileEntry, now time.Time) {
+	d.pending[entry.Path] = &pendingRemoval{entry, now}
+}
+
+/**
+ * Looks for a removed file that stat, the file created at file, could be
+ * the new name of. The inode is tried first, the content only if needed
+ * since it has to be hashed. Returns the entry of the old name or nil
+ **/
+func (d *renameDetector) Match(s *Share, file string, stat os.FileInfo) *FileEntry {
+	if stat.IsDir() || len(d.pending) == 0 {
+		return nil
+	}
+
+	inode, size := fileInode(stat), stat.Size()
+	mtime := stat.ModTime().UTC().Unix()
+
+	var hash []byte
+
+	for old, p := range d.pending {
+		e := p.entry
+
+		if e.Size != size {
+			continue
+		}
+
+		//Renames keep the inode and modification time
+		if inode != 0 && e.Inode == inode && e.ModTime == mtime {
+			delete(d.pending, old)
+			return e
+		}
+
+		if hash == nil {
+			var err error
+
+			hash, err = s.hashFile(file, stat)
+
+			if err != nil {
+				return nil
+			}
+		}
+
+		if bytes.Equal(hash, e.Hash) {
+			delete(d.pending, old)
+			return e
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Returns the removals which waited long enough to not be renames
+ **/
+func (d *renameDetector) Expired(now time.Time) (entries []*FileEntry) {
+	for old, p := range d.pending {
+		if now.Sub(p.at) >= renameWindow {
+			entries = append(entries, p.entry)
+			delete(d.pending, old)
+		}
+	}
+
+	return
+}
+
+func (d *renameDetector) FolderRemoved(dir string, now time.Time) {
+	d.folders[dir] = now
+}
+
+/**
+ * Returns the removed folders whose files expired, the folders they held
+ * coming before them
+ **/
+func (d *renameDetector) ExpiredFolders(now time.Time) (dirs []string) {
+	for dir, at := range d.folders {
+		if now.Sub(at) >= renameWindow {
+			dirs = append(dirs, dir)
+			delete(d.folders, dir)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	return
+}
+
+/**
+ * Moves the index entry of from, which must already be renamed on disk, to
+ * to and records the removal of from. vector is the version of the rename
+ * sent by a peer, nil if the file was renamed locally
+ **/
+func (s *Share) IndexRename(from, to string, vector VersionVector) (entry *FileEntry, err error) {
+	entry, err = s.StoredEntry(from)
+
+	if err != nil {
+		return
+	}
+
+	if entry == nil || entry.Deleted {
+		return nil, os.ErrNotExist
+	}
+
+	blocks, err := s.StoredBlocks(from)
+
+	if err != nil {
+		return
+	}
+
+	stat, err := s.statFile(to)
+
+	if err != nil {
+		return
+	}
+
+	if vector != nil {
+		entry.Vector = entry.Vector.Merge(vector)
+	} else {
+		entry.Vector = entry.Vector.Increment(LocalFingerprint)
+	}
+
+	entry.Path = to
+	entry.Version++
+	entry.ModTime = stat.ModTime().UTC().Unix()
+	entry.Inode = fileInode(stat)
+
+	err = s.StoreBlocks(to, blocks)
+
+	if err != nil {
+		return
+	}
+
+	err = s.StoreEntry(entry)
+
+	if err != nil {
+		return
+	}
+
+	//Same vector as the new name so every peer ends with the same removal
+	_, err = s.Tombstone(from, entry.Vector)
+
+	return
+}
+
+/**
+ * Renames from to to as renamed by a peer
+ **/
+func (s *Share) Move(from, to string, vector VersionVector) (err error) {
+	target, err := s.parentPath(to)
+
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(path.Dir(target), 0755)
+
+	if err != nil {
+		return
+	}
+
+	err = s.Rename(from, to)
+
+	if err != nil {
+		return
+	}
+
+	_, err = s.IndexRename(from, to, vector)
+
+	return
+}
+
+/**
+ * Tells the clients of the share that from was renamed, e being the entry
+ * of the new name
+ **/
+func (sh *ShareHandler) AnnounceRename(from string, e *FileEntry) {
+	msg := &light.FileMessage{
+		Filename:    proto.String(e.Path),
+		ShareName:   proto.String(sh.Name),
+		Folder:      proto.Bool(false),
+		Action:      light.FileAction_RENAMED.Enum(),
+		Hash:        e.Hash,
+		Version:     e.Vector.Proto(),
+		Mtime:       proto.Int64(e.ModTime),
+		OldFilename: proto.String(from),
+	}
+
+	msg.Type, msg.Target = fileTypeToProto(e)
+	msg.Mode, msg.Uid, msg.Gid = metadataToProto(e)
+	msg.Xattrs = xattrsToProto(e.Xattrs)
+
+	sh.NotifyClients(&FileMessageWrapper{MessageWrapper{nil}, msg})
+}
+
+/**
+ * Renames our copy of a file renamed by a peer, provided it is the copy the
+ * peer renamed. Otherwise the new name is fetched and the old one removed
+ * like for any other change
+ **/
+func (sh *ShareHandler) HandleRename(msg *FileMessageWrapper) {
+	peer := msg.Sender()
+	from, to := msg.GetOldFilename(), msg.GetFilename()
+	vector := VersionVectorFromProto(msg.GetVersion())
+	link := targetFromProto(msg.GetType(), msg.GetTarget())
+
+	if modified, err := sh.CheckFileShallow(from); err == nil && modified {
+		sh.CheckFileDeep(from)
+	}
+
+	local, err := sh.StoredEntry(from)
+
+	if err != nil {
+		LogObj.Println("Could not read index entry of", from, ":", err)
+		return
+	}
+
+	target, err := sh.StoredEntry(to)
+
+	if err == nil && local != nil && !local.Deleted &&
+		(target == nil || target.Deleted) &&
+		bytes.Equal(local.Hash, msg.GetHash()) && local.Target == link &&
+		vector.Compare(local.Vector) == VersionNewer {
+		sh.ExpectRemoval(from)
+		sh.ExpectFile(to, msg.GetHash())
+
+		err = sh.Move(from, to, vector)
+
+		if err == nil {
+			LogObj.Println("Renamed", from, "to", to, "as renamed by", peer.Name())
+			return
+		}
+
+		LogObj.Println("Could not rename", from, "to", to, ":", err)
+	}
+
+	sh.Reconcile(peer, &FileEntry{
+		Path:    to,
+		Hash:    msg.GetHash(),
+		ModTime: msg.GetMtime(),
+		Vector:  vector,
+		Target:  link,
+		Mode:    msg.GetMode(),
+		HasMode: msg.Mode != nil,
+		Uid:     msg.GetUid(),
+		Gid:     msg.GetGid(),
+		Xattrs:  xattrsFromProto(msg.GetXattrs()),
+	})
+
+	sh.Reconcile(peer, &FileEntry{Path: from, Deleted: true, Vector: vector})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRenameDetector(t *testing.T) {
+	f, err := ioutil.TempFile("", "rename")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+
+	f.Write([]byte("content"))
+	f.Close()
+
+	stat, err := os.Stat(f.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fileInode(stat) == 0 {
+		t.Skip("No inode numbers on this system")
+	}
+
+	now := time.Now()
+	d := newRenameDetector()
+
+	d.Removed(&FileEntry{
+		Path:    "old",
+		Size:    stat.Size(),
+		ModTime: stat.ModTime().UTC().Unix(),
+		Inode:   fileInode(stat),
+	}, now)
+	d.Removed(&FileEntry{Path: "gone", Size: stat.Size() + 1}, now)
+
+	if e := d.Match(nil, "new", stat); e == nil || e.Path != "old" {
+		t.Error("Rename not detected: ", e)
+	}
+
+	if e := d.Match(nil, "new", stat); e != nil {
+		t.Error("Removal matched twice: ", e)
+	}
+
+	if expired := d.Expired(now); len(expired) != 0 {
+		t.Error("Removal expired too early: ", expired)
+	}
+
+	expired := d.Expired(now.Add(renameWindow))
+
+	if len(expired) != 1 || expired[0].Path != "gone" {
+		t.Error("Removal did not expire: ", expired)
+	}
+}
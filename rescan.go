@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const (
+	//Time between two walks of a share looking for missed changes
+	DefaultRescanInterval time.Duration = time.Hour
+)
+
+func (s *Share) RescanInterval() time.Duration {
+	if s.Config.RescanInterval > 0 {
+		return time.Duration(s.Config.RescanInterval)
+	}
+
+	return DefaultRescanInterval
+}
+
+func (s *Share) IsWatched(dir string) bool {
+	s.watchMutex.Lock()
+	defer s.watchMutex.Unlock()
+
+	return s.watched[dir]
+}
+
+/**
+ * Walks the whole share looking for the changes the watcher missed, e.g.
+ * after an overflow, and handles them like the ones it reports
+ **/
+func (sh *ShareHandler) Rescan() {
+	start := time.Now()
+	limited := false
+
+	err := filepath.Walk(sh.Path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			LogObj.Println("Could not read", p, ":", err)
+			return nil
+		}
+
+		rel, ignored := sh.walkedPath(p, info)
+
+		if ignored {
+			return skipEntry(info)
+		}
+
+		if !info.IsDir() {
+			sh.localChange(rel)
+			return nil
+		}
+
+		if sh.IsWatched(p) {
+			return nil
+		}
+
+		//Created while we were not watching
+		err = sh.watchDir(p)
+
+		switch {
+		case err == ErrWatchLimit:
+			if !limited {
+				LogObj.Println("Can not watch", p, "and the folders after it:", err)
+				limited = true
+			}
+
+		case err != nil:
+			LogObj.Println("Could not watch", p, ":", err)
+
+		case rel != ".":
+			sh.AnnounceFolder(rel)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		LogObj.Println("Could not walk share", sh.Name, ":", err)
+		return
+	}
+
+	var indexed []string
+
+	err = sh.ForEachEntry(0, func(e *FileEntry) error {
+		if !e.Deleted && !sh.Ignored(e.Path, false) {
+			indexed = append(indexed, e.Path)
+		}
+		return nil
+	})
+
+	if err != nil {
+		LogObj.Println("Could not read index of share", sh.Name, ":", err)
+		return
+	}
+
+	//Files removed without us noticing
+	for _, f := range indexed {
+		if _, err := os.Lstat(path.Join(sh.Path, f)); os.IsNotExist(err) {
+			sh.localChange(f)
+		}
+	}
+
+	LogObj.Println("Rescanned share", sh.Name, "in", time.Since(start))
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"crypto/rsa"
+	"crypto/tls"
 	"fmt"
+	"lightsync/proto"
 	"log"
 	"net"
 	"os"
@@ -16,13 +18,19 @@ type Client struct {
 	key       *rsa.PublicKey
 	conn      net.Conn
 	name      string
+
+	version  uint32          //Protocol version negotiated during handshake
+	features map[string]bool //Optional features supported by both sides
 }
 
 var Config ConfigurationObject
-var Shares map[string]Share
-var Clients map[string]*Client
+var Shares = make(map[string]Share)
+var ShareHandlers = make(map[string]*ShareHandler)
+var Clients = make(map[string]*Client)
 var Running = true
 
+var LocalFingerprint string //Identifies our changes in version vectors
+
 var LogObj *log.Logger
 
 var FileMessageHandlers []MessageHandler
@@ -34,49 +42,109 @@ func main() {
 	LogObj.SetPrefix("lightsync ")
 	LogObj.Printf("starting...\n")
 
-	address, port := "localhost", "12000"
+	tlsConfig, err := DefaultTLSConfig()
 
-	addr, err := net.ResolveTCPAddr("tcp", address+":"+port)
+	if err == nil {
+		LocalFingerprint = ConfigFingerprint(tlsConfig)
+	} else {
+		LogObj.Println("Could not load TLS configuration:", err)
+	}
 
-	signalChannel := make(chan os.Signal, 10)
+	//Our changes could not be told apart from the ones of peers
+	if LocalFingerprint == "" {
+		LogObj.Println("No fingerprint for our key, not starting")
+		return
+	}
 
-	signal.Notify(signalChannel, os.Kill, os.Interrupt)
+	jcfg, err := NewJSONConfiguration(DefaultConfigFile)
 
 	if err != nil {
 		return
 	}
 
-	ln, err := net.ListenTCP("tcp", addr)
+	Config = jcfg
 
-	go SignalHandler(signalChannel, ln)
+	StartShares(jcfg.Shares)
+
+	address, port := "localhost", "12000"
+
+	signalChannel := make(chan os.Signal, 10)
+
+	signal.Notify(signalChannel, os.Kill, os.Interrupt)
+
+	//Peers are named after the key they authenticate with
+	ln, err := tls.Listen("tcp", address+":"+port, tlsConfig)
 
 	if err != nil {
+		LogObj.Println("Could not listen for peers:", err)
 		return
 	}
 
+	go SignalHandler(signalChannel, ln)
+
 	for {
-		conn, err := ln.AcceptTCP()
+		conn, err := ln.Accept()
 
 		if err != nil {
 			break
 		}
 
-		name, err := ClientHandshake(conn)
+		name, err := PeerFingerprint(conn)
 
 		if err != nil {
-			fmt.Printf("Error while handshaking with %s:\n",
-				conn.RemoteAddr().String())
-			fmt.Print(err)
+			LogObj.Printf("Refusing session with %s: %s\n",
+				conn.RemoteAddr().String(), err)
+			conn.Close()
+			continue
+		}
+
+		hello, err := ClientHandshake(conn)
+
+		if err != nil {
+			LogObj.Printf("Error while handshaking with %s: %s\n",
+				conn.RemoteAddr().String(), err)
+			conn.Close()
 			continue
 		}
 
 		client := NewClientHandler(name, conn)
 
+		client.SetHello(hello)
+
 		Clients[name] = &client
+
+		EnterShares(&client)
+	}
+}
+
+/**
+ * Opens the configured shares and starts a handler for each of them
+ **/
+func StartShares(configs []ShareConfig) {
+	for _, cfg := range configs {
+		share, err := NewShareFromConfig(cfg)
+
+		if err != nil {
+			LogObj.Println("Could not open share", cfg.Name, ":", err)
+			continue
+		}
+
+		Shares[cfg.Name] = *share
+		ShareHandlers[cfg.Name] = NewShareHandler(*share, make(chan Message, 10))
 	}
 }
 
-func SignalHandler(signals chan os.Signal, ln *net.TCPListener) {
+/**
+ * Enters every configured share with client once the handshake completed,
+ * the ones client is not allowed in are left out by their handler
+ **/
+func EnterShares(client *Client) {
+	for _, sh := range ShareHandlers {
+		sh.PeerConnected(client)
+	}
+}
+
+func SignalHandler(signals chan os.Signal, ln net.Listener) {
 	for {
 		sig := <-signals
 
@@ -120,41 +188,26 @@ func (c *Client) Stop() {
 	c.controlCh <- 0
 }
 
-func ClientHandshake(conn net.Conn) (name string, err error) {
-	var msg Message
-
-
+/**
+ * Records what was negotiated in the Hello exchange with the client
+ **/
+func (c *Client) SetHello(hello *light.Hello) {
+	c.version = NegotiatedVersion(hello)
+	c.features = CommonFeatures(hello)
 
-	msg, err = ReadMessage(conn)
-
-	switch msg.(type) {
-
-	}
-
-	if err != nil {
-		fmt.Printf("Error while handshaking with %s:\n",
-			conn.RemoteAddr().String())
-		fmt.Print(err)
-		return
-	}
-
-	if err != nil {
-		fmt.Printf("Error while handshaking with %s:\n",
-			conn.RemoteAddr().String())
-		fmt.Print(err)
-		conn.Close()
-		return
-	}
-
-	return
+	LogObj.Println("Client", c.name, "speaks protocol version", c.version,
+		"with features", hello.GetFeatures())
 }
 
+func (c *Client) HasFeature(feature string) bool {
+	return c.features[feature]
+}
 
 func (c *Client) ClientWriter(input <-chan Message, conn net.Conn) {
 	for {
 		select {
 		case msg := <-input:
-			err := msg.WriteTo(conn)
+			_, err := msg.WriteTo(conn)
 
 			if err != nil {
 				fmt.Printf("Error while writing to client %s:\n",
@@ -173,8 +226,6 @@ func (c *Client) ClientReader(output chan<- Message, conn net.Conn) {
 	for {
 		msg, err := ReadMessage(conn)
 
-		msg.SetSender(c)
-
 		if err != nil {
 			LogObj.Printf("Error while reading from client %s\n",
 				conn.RemoteAddr().String())
@@ -182,6 +233,8 @@ func (c *Client) ClientReader(output chan<- Message, conn net.Conn) {
 			return
 		}
 
+		msg.SetSender(c)
+
 		output <- msg
 	}
 }
@@ -2,16 +2,17 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"database/sql"
 	"errors"
-	"fmt"
 
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 )
 
 //External imports
@@ -27,15 +28,26 @@ type Share struct {
 	Watcher *fsnotify.Watcher
 
 	Database *sql.DB
+	Config   ShareConfig
 
 	clientMutex *sync.Mutex
+
+	watched    map[string]bool //Folders registered with the watcher
+	watchMutex *sync.Mutex
+
+	ignores *IgnoreMatcher
 }
 
 const (
-	FileChunkSize int64 = 1024 ^ 2
+	FileChunkSize int64 = 1024 * 1024
 )
 
+var ErrWatchLimit = errors.New("Out of inotify watches, raise fs.inotify.max_user_watches!")
+
 func NewShare(name, path string) (s *Share, err error) {
+	if LocalFingerprint == "" {
+		return nil, errors.New("No local fingerprint to version changes with!")
+	}
 
 	wat, err := fsnotify.NewWatcher()
 
@@ -43,14 +55,59 @@ func NewShare(name, path string) (s *Share, err error) {
 		return
 	}
 
-	db, err := sql.Open("sqlite3", "temp.db")
+	db, err := OpenIndex(path)
 
 	if err != nil {
+		wat.Close()
 		LogObj.Println("Could not open the database for share ", name, ": ", err)
 		return
 	}
 
-	s = &Share{name, make(map[string]*Client), path, wat, db, &sync.Mutex{}}
+	s = &Share{
+		Name:        name,
+		Clients:     make(map[string]*Client),
+		Path:        path,
+		Watcher:     wat,
+		Database:    db,
+		Config:      ShareConfig{Name: name, Path: path},
+		clientMutex: &sync.Mutex{},
+		watched:     make(map[string]bool),
+		watchMutex:  &sync.Mutex{},
+		ignores:     &IgnoreMatcher{},
+	}
+
+	err = s.LoadIgnores()
+
+	if err != nil {
+		LogObj.Println("Could not read ignore patterns of share", name, ":", err)
+		err = nil
+	}
+
+	err = s.CleanTempFiles()
+
+	if err != nil {
+		LogObj.Println("Could not clean temporary files of share", name, ":", err)
+		err = nil
+	}
+
+	return
+}
+
+func NewShareFromConfig(cfg ShareConfig) (s *Share, err error) {
+	s, err = NewShare(cfg.Name, cfg.Path)
+
+	if err != nil {
+		return
+	}
+
+	s.Config = cfg
+
+	err = s.LoadIgnores()
+
+	if err != nil {
+		LogObj.Println("Could not read ignore patterns of share", cfg.Name, ":", err)
+		err = nil
+	}
 
 	return
 }
@@ -68,6 +125,33 @@ func (s *Share) AddClient(client *Client) {
 	}
 }
 
+func (s *Share) HasClient(client *Client) bool {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	_, contains := s.Clients[client.Name()]
+
+	return contains
+}
+
+/**
+ * Tells whether client is allowed to take part in the share, clients being
+ * named after the fingerprint of their key
+ **/
+func (s *Share) Authorized(client *Client) bool {
+	if client == nil {
+		return false
+	}
+
+	for _, id := range s.Config.AuthorizedClients {
+		if id == client.Name() {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (s *Share) RemoveClient(client *Client) {
 	s.clientMutex.Lock()
 	defer s.clientMutex.Unlock()
@@ -89,7 +173,11 @@ func (s *Share) NotifyClients(msg Message) {
 }
 
 func (s *Share) CreateFile(file string) (err error) {
-	file = path.Join(s.Path, file)
+	file, err = s.SharePath(file)
+
+	if err != nil {
+		return
+	}
 
 	_, err = os.Stat(file)
 
@@ -109,62 +197,48 @@ func (s *Share) CreateFile(file string) (err error) {
 	return nil
 }
 
-func (s *Share) CreateDir(dir string) error {
-	dir = path.Join(s.Path, dir)
-
-	stat, err := os.Stat(path.Clean(dir))
-
-	if err == nil {
-		if !stat.IsDir() {
-			return errors.New("A file with the name " + dir + " already exists!\n")
-		}
-		return nil
-	}
-
-	err = os.Mkdir(dir, 0755)
-
-	return err
-}
-
-func (s *Share) WriteChunk(file string, partnum int64, part []byte) (err error) {
-	var fd *os.File
-
-	file = path.Join(s.Path, file)
-
-	fd, err = os.OpenFile(file, os.O_RDWR, os.ModeExclusive)
-
-	defer fd.Close()
+/**
+ * Creates dir with the permission bits mode, 0755 when nil. The bits are
+ * applied to dir when it already exists
+ **/
+func (s *Share) CreateDir(dir string, mode *uint32) error {
+	dir, err := s.SharePath(dir)
 
 	if err != nil {
-		LogObj.Println("Fatal error while opening ", file, " for update: ", err)
 		return err
 	}
 
-	s.Watcher.Remove(file)
+	perm := os.FileMode(0755)
 
-	defer s.Watch(file)
-
-	if int64(len(part)) != FileChunkSize {
-		LogObj.Println("Invalid chunk size ", len(part), " in ", file, ". Last chunk?")
+	if mode != nil {
+		perm = os.FileMode(*mode).Perm()
 	}
 
-	_, err = fd.Seek(partnum*FileChunkSize, 0)
+	stat, err := os.Stat(path.Clean(dir))
+
+	if err == nil && !stat.IsDir() {
+		return errors.New("A file with the name " + dir + " already exists!\n")
+	}
 
-	fd.Write(part)
+	if err == nil && mode == nil {
+		return nil
+	}
 
 	if err != nil {
-		fmt.Printf("Error updating chunk %d in %s:", partnum, file)
-		LogObj.Println(err)
-		return err
+		err = os.Mkdir(dir, perm)
+
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	//Mkdir is subject to the umask
+	return os.Chmod(dir, perm)
 }
 
 func (s *Share) ReadChunk(file string, partnum int64) (chunk []byte, err error) {
-	file = path.Join(s.Path, file)
-
-	fd, err := os.OpenFile(file, os.O_RDWR, os.ModeExclusive)
+	//Read only, files we may not write to are served as well
+	fd, err := s.OpenFile(file)
 
 	if err != nil {
 		return
@@ -176,6 +250,11 @@ func (s *Share) ReadChunk(file string, partnum int64) (chunk []byte, err error)
 
 	n, err := fd.ReadAt(chunk, FileChunkSize*partnum)
 
+	if err == io.EOF && n > 0 {
+		//Last chunk of the file is usually not complete
+		err = nil
+	}
+
 	if err != nil {
 		return
 	}
@@ -190,110 +269,307 @@ func (s *Share) ReadChunk(file string, partnum int64) (chunk []byte, err error)
 	return
 }
 
-func (s *Share) Remove(object string) {
-	object = path.Join(s.Path, object)
+func (s *Share) OpenFile(file string) (*os.File, error) {
+	full, err := s.SharePath(file)
+
+	if err != nil {
+		return nil, err
+	}
 
-	os.Remove(object)
-	//TODO: notify DB of removal
+	return os.Open(full)
 }
 
-func (s *Share) FromOffline(dir string) error {
-	if len(dir) == 0 {
-		defer s.Watch(s.Path)
+/**
+ * Creates a temporary file inside the share, on the same filesystem as the
+ * files it may replace
+ **/
+func (s *Share) TempFile(prefix string) (*os.File, error) {
+	return ioutil.TempFile(path.Join(s.Path, MetaDirName), prefix)
+}
 
-		dirinfo, err := os.Stat(s.Path)
+/**
+ * Returns the path of name, as given by the watcher, relative to the share
+ **/
+func (s *Share) RelPath(name string) (string, error) {
+	rel, err := filepath.Rel(s.Path, name)
 
-		if dirinfo.IsDir() && err == nil {
-			s.FromOffline(s.Path)
-		} else {
-			return errors.New("Invalid share path: " + dir + "!")
-		}
-	} else {
-		dirinfo, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
 
-		if !dirinfo.IsDir() || err != nil {
-			return nil
-		}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", errors.New("Path outside of share: " + name + "!")
+	}
+
+	return filepath.ToSlash(rel), nil
+}
 
-		files, err := ioutil.ReadDir(dir)
+func (s *Share) Rename(from, to string) error {
+	source, err := s.parentPath(from)
+
+	if err != nil {
+		return err
+	}
+
+	target, err := s.parentPath(to)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(source, target)
+}
+
+/**
+ * Copies file to copy, which must not exist yet, keeping its mode and
+ * modification time. Symlinks are copied as links. The copy is assembled
+ * in a temporary file so that it never shows up half written
+ **/
+func (s *Share) CopyFile(file, copy string) (err error) {
+	from, err := s.parentPath(file)
+
+	if err != nil {
+		return
+	}
+
+	to, err := s.parentPath(copy)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = os.Lstat(to); err == nil {
+		return errors.New("File " + copy + " already exists!")
+	}
+
+	stat, err := os.Lstat(from)
+
+	if err != nil {
+		return
+	}
+
+	if isSymlink(stat) {
+		target, err := os.Readlink(from)
 
 		if err != nil {
-			LogObj.Println("Error reading directory ", dir, ": ", err)
-			return err //Resuming recursing in other subdirs
+			return err
 		}
 
-		for _, f := range files {
-			mod, err := s.CheckFileShallow(f.Name())
-			if err != nil {
-				LogObj.Print("Could not read ", f.Name(), ": ", err)
-				continue
-			}
+		return os.Symlink(target, to)
+	}
 
-			if mod {
-				s.CheckFileDeep(f.Name())
-			}
-		}
+	src, err := os.Open(from)
+
+	if err != nil {
+		return
 	}
-	return nil
-}
 
-func (s *Share) CheckFileShallow(path string) (modified bool, err error) {
-	stat, err := os.Stat(path)
+	defer src.Close()
+
+	tmp, err := s.TempFile(partialPrefix)
 
 	if err != nil {
 		return
 	}
 
-	mtime, err := s.StoredModTime(path)
+	_, err = io.Copy(tmp, src)
 
-	modified = (mtime == stat.ModTime().UTC().Unix())
-	//Time stored as UTC to avoid problems with timezones
+	if err == nil {
+		err = tmp.Chmod(stat.Mode().Perm())
+	}
+
+	tmp.Close()
+
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), stat.ModTime(), stat.ModTime())
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), to)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
 
 	return
 }
 
-func (s *Share) CheckFileDeep(path string) (modified bool, err error) {
-	file, err := os.Open(path)
+/**
+ * Removes object from the share and records the removal in the index.
+ * vector is the version of the removal sent by a peer, nil if it was
+ * decided locally
+ **/
+func (s *Share) Remove(object string, vector VersionVector) error {
+	full, err := s.parentPath(object)
 
 	if err != nil {
+		return err
+	}
+
+	err = os.Remove(full)
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	_, err = s.Tombstone(object, vector)
+
+	return err
+}
+
+/**
+ * Compares size and modification time of file with the ones stored in the
+ * index. file is relative to the share root
+ **/
+func (s *Share) CheckFileShallow(file string) (modified bool, err error) {
+	stat, err := s.statFile(file)
+
+	if err != nil && !os.IsNotExist(err) {
 		return
 	}
 
-	defer file.Close()
+	missing := (err != nil)
 
-	hasher := sha1.New()
+	if !missing && stat.IsDir() {
+		return false, nil
+	}
 
-	_, err = io.Copy(hasher, file)
+	entry, err := s.StoredEntry(file)
 
 	if err != nil {
 		return
 	}
 
-	lastHash, err := s.StoredHash(path)
-	currentHash := hasher.Sum(nil)
+	//A missing file is only a change if we did not know it was removed
+	if missing {
+		return entry != nil && !entry.Deleted, nil
+	}
 
-	if len(lastHash) != len(currentHash) {
-		//Consider file modified if stored hash is invalid ?
+	if entry == nil || entry.Deleted {
 		return true, nil
 	}
 
-	modified = (bytes.Compare(currentHash, lastHash) == 0)
+	//Time stored as UTC to avoid problems with timezones
+	modified = (entry.ModTime != stat.ModTime().UTC().Unix() ||
+		entry.Size != stat.Size() || isSymlink(stat) != (entry.Target != "") ||
+		s.metadataChanged(entry, stat))
 
-	if modified {
-		//TODO: Write modification into database
+	if !entry.HasMode && !isSymlink(stat) {
+		//Indexed before modes were, hashing it again records it
+		modified = true
 	}
 
 	return
 }
 
-func (s *Share) StoredModTime(path string) (mtime int64, err error) {
-	//TODO: Retrieve stored info from database
+/**
+ * Hashes the content of file and compares it to the stored hash.
+ * The index and block hashes are updated and the version bumped when the
+ * content changed locally
+ **/
+func (s *Share) CheckFileDeep(file string) (modified bool, err error) {
+	return s.IndexFile(file, nil)
+}
 
-	return
+/**
+ * Same as CheckFileDeep but the content comes from a peer: vector is the
+ * version it sent and is merged into ours instead of bumping our counter.
+ * A nil vector means the change was made locally
+ **/
+func (s *Share) IndexFile(file string, vector VersionVector) (modified bool, err error) {
+	stat, err := s.statFile(file)
+
+	if os.IsNotExist(err) {
+		return s.Tombstone(file, vector)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if isSymlink(stat) {
+		return s.indexSymlink(file, stat, vector)
+	}
+
+	fd, err := os.Open(path.Join(s.Path, file))
+
+	if err != nil {
+		return
+	}
+
+	defer fd.Close()
+
+	stat, err = fd.Stat()
+
+	if err != nil {
+		return
+	}
+
+	currentHash, blocks, err := HashBlocks(fd)
+
+	if err != nil {
+		return
+	}
+
+	return s.storeIndexed(file, stat, currentHash, blocks, "", vector)
 }
 
-func (s *Share) StoredHash(path string) (hash []byte, err error) {
-	//TODO: Retrieve stored hash from database
+/**
+ * Records in the index that file, described by stat, hashes to hash.
+ * target is the one of symlinks, empty for regular files
+ **/
+func (s *Share) storeIndexed(file string, stat os.FileInfo, hash []byte,
+	blocks [][]byte, target string, vector VersionVector) (modified bool, err error) {
+
+	entry, err := s.StoredEntry(file)
+
+	if err != nil {
+		return
+	}
+
+	if entry == nil {
+		entry = &FileEntry{Path: file}
+	}
+
+	//Consider file modified if stored hash is invalid
+	modified = entry.Deleted || !bytes.Equal(hash, entry.Hash) ||
+		entry.Target != target || s.metadataChanged(entry, stat)
+
+	if vector != nil {
+		entry.Vector = entry.Vector.Merge(vector)
+	} else if modified {
+		entry.Vector = entry.Vector.Increment(LocalFingerprint)
+	}
+
+	if modified {
+		entry.Version++
+
+		err = s.StoreBlocks(file, blocks)
+
+		if err != nil {
+			return
+		}
+	}
+
+	entry.Size = stat.Size()
+	entry.ModTime = stat.ModTime().UTC().Unix()
+	entry.Hash = hash
+	entry.Target = target
+	entry.Deleted = false
+	entry.Inode = fileInode(stat)
+	entry.Mode, entry.Uid, entry.Gid = 0, 0, 0
+	entry.HasMode = (target == "")
+
+	if target == "" {
+		entry.Mode = fileMode(stat)
+		entry.Uid, entry.Gid = fileOwner(stat)
+	}
+
+	entry.Xattrs = s.readXattrs(file, stat)
+
+	err = s.StoreEntry(entry)
+
 	return
 }
 
@@ -307,24 +583,76 @@ func (s *Share) Errors() chan error {
 
 func (s *Share) Close() {
 	s.Watcher.Close()
+	s.Database.Close()
 }
 
+/**
+ * Watches folder dir, a full path, and all the folders below it. Files do
+ * not need their own watch, their folder reports their changes
+ **/
 func (s *Share) Watch(dir string) error {
-	finfo, err := ioutil.ReadDir(dir)
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == dir {
+				return err
+			}
+
+			//Removed in the meantime or unreadable, keep watching the others
+			LogObj.Println("Could not read", p, ":", err)
+			return nil
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if _, ignored := s.walkedPath(p, info); ignored {
+			return filepath.SkipDir
+		}
+
+		return s.watchDir(p)
+	})
+}
+
+func (s *Share) watchDir(dir string) error {
+	s.watchMutex.Lock()
+	defer s.watchMutex.Unlock()
+
+	if s.watched[dir] {
+		return nil
+	}
+
+	err := s.Watcher.Add(dir)
+
+	if err == syscall.ENOSPC {
+		return ErrWatchLimit
+	}
 
 	if err != nil {
 		return err
 	}
 
-	for _, f := range finfo {
-		if f.IsDir() {
-			err := s.Watch(dir + f.Name())
-			if err != nil {
-				return err
-			}
-		} else {
-			s.Watcher.Add(dir + f.Name())
+	s.watched[dir] = true
+
+	return nil
+}
+
+/**
+ * Stops watching folder dir and the folders below it as it was removed or
+ * moved away. Returns the folders that were watched
+ **/
+func (s *Share) Unwatch(dir string) (unwatched []string) {
+	s.watchMutex.Lock()
+	defer s.watchMutex.Unlock()
+
+	for w := range s.watched {
+		if w == dir || strings.HasPrefix(w, dir+"/") {
+			//Fails for removed folders, the watch is already gone
+			s.Watcher.Remove(w)
+			delete(s.watched, w)
+			unwatched = append(unwatched, w)
 		}
 	}
-	return nil
+
+	return
 }
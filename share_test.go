@@ -3,9 +3,19 @@ package main
 import (
 	"bytes"
 	crand "crypto/rand"
+	"crypto/sha1"
+	"io/ioutil"
 	mrand "math/rand"
 	"os"
+	"path"
+	"sync"
 	"testing"
+	"time"
+)
+
+//External imports
+import (
+	"github.com/go-fsnotify/fsnotify"
 )
 
 const (
@@ -13,6 +23,7 @@ const (
 	TestNumber       = 1000
 	ShareDir         = "/tmp/lightsync/"
 	TestFile         = "test.001"
+	TestPeerId       = "0123456789abcdef"
 )
 
 var Sh *Share
@@ -21,6 +32,10 @@ var Success bool = true
 
 func InitShare(t *testing.T) {
 	t.Log("Creating tempdir for share...")
+
+	//The index is kept in the share, start over from an empty one
+	os.RemoveAll(ShareDir)
+
 	err := os.Mkdir(ShareDir, os.ModeDir|os.ModePerm)
 
 	defer func() { Success = (err == nil) }()
@@ -30,6 +45,7 @@ func InitShare(t *testing.T) {
 		return
 	}
 
+	LocalFingerprint = TestPeerId
 	Sh, err = NewShare("test", ShareDir)
 
 	if err != nil {
@@ -38,6 +54,44 @@ func InitShare(t *testing.T) {
 	}
 }
 
+/**
+ * Share without index rooted in a new temporary folder, removed by cleanup
+ **/
+func TempShare(t *testing.T) (s *Share, cleanup func()) {
+	initLog()
+
+	root, err := ioutil.TempDir("", "lightsync")
+
+	if err != nil {
+		t.Fatal("Could not create test folder: ", err)
+	}
+
+	s = &Share{Path: root}
+	cleanup = func() { os.RemoveAll(root) }
+	return
+}
+
+/**
+ * Share with a new index in a temporary folder, closed and removed by cleanup
+ **/
+func TempIndexedShare(t *testing.T) (s *Share, cleanup func()) {
+	tmp, remove := TempShare(t)
+
+	LocalFingerprint = TestPeerId
+	s, err := NewShare("temp", tmp.Path)
+
+	if err != nil {
+		remove()
+		t.Fatal("Could not create test share: ", err)
+	}
+
+	cleanup = func() {
+		s.Close()
+		remove()
+	}
+	return
+}
+
 func TestCreateShare(t *testing.T) {
 	if Sh == nil {
 		InitShare(t)
@@ -120,19 +174,54 @@ func TestWriteChunk(t *testing.T) {
 
 	defer func() { Success = (err == nil) }()
 
+	file := "chunks.001"
+
+	os.Remove(path.Join(ShareDir, file))
+	defer os.Remove(path.Join(ShareDir, file))
+
+	tr := &transfer{size: int64(FileChunkNum) * FileChunkSize}
+
+	tr.out, err = Sh.NewPartial(file, tr.size)
+
+	if err != nil {
+		t.Error("Could not create partial download: ", err)
+		return
+	}
+
+	written := make(map[int64][]byte)
+
 	for i := 0; i < TestNumber; i++ {
 		var partnum int64 = int64(mrand.Intn(FileChunkNum))
 
 		data := make([]byte, FileChunkSize)
+		data[0], data[FileChunkSize-1] = byte(i), byte(partnum)
 
-		err = Sh.WriteChunk(TestFile, partnum, data)
+		err = tr.WriteChunk(partnum, data)
 
 		if err != nil {
 			t.Error("Could not write chunk: ", err)
+			tr.Abort()
 			return
 		}
 
-		rddata, err := Sh.ReadChunk(TestFile, partnum)
+		written[partnum] = data
+	}
+
+	tr.out.Seek(0, 0)
+
+	hash, _, err := HashBlocks(tr.out)
+
+	if err == nil {
+		err = Sh.CommitPartial(tr.out, file, hash)
+	}
+
+	if err != nil {
+		t.Error("Could not commit partial download: ", err)
+		return
+	}
+
+	for partnum, data := range written {
+		rddata, err := Sh.ReadChunk(file, partnum)
 
 		if err != nil {
 			t.Error("Could not read chunk: ", err)
@@ -144,4 +233,340 @@ func TestWriteChunk(t *testing.T) {
 			return
 		}
 	}
+
+	//Never indexed, the file now looks like one created locally
+	tr.out, err = Sh.NewPartial(file, 0)
+
+	if err == nil {
+		err = Sh.CommitPartial(tr.out, file, sha1.New().Sum(nil))
+	}
+
+	if err != ErrLocalChange {
+		t.Error("Local change replaced by a transfer: ", err)
+		return
+	}
+
+	err = nil
+}
+
+func TestIndexEntry(t *testing.T) {
+	if !Success || Sh == nil {
+		t.Skip("Previous test failed can't test this!")
+	}
+
+	var err error
+
+	defer func() { Success = (err == nil) }()
+
+	modified, err := Sh.CheckFileDeep(TestFile)
+
+	if err != nil {
+		t.Error("Could not hash test file: ", err)
+		return
+	}
+
+	if !modified {
+		t.Error("Freshly written file not detected as modified!")
+	}
+
+	modified, err = Sh.CheckFileShallow(TestFile)
+
+	if err != nil || modified {
+		t.Error("File reported as modified right after indexing: ", err)
+		return
+	}
+
+	entry, err := Sh.StoredEntry(TestFile)
+
+	if err != nil || entry == nil {
+		t.Error("Could not retrieve index entry: ", err)
+		return
+	}
+
+	if entry.Version < 1 || len(entry.Hash) == 0 {
+		t.Error("Unexpected index entry: ", entry)
+	}
+}
+
+func TestIndexSequence(t *testing.T) {
+	if !Success || Sh == nil {
+		t.Skip("Previous test failed can't test this!")
+	}
+
+	var err error
+
+	defer func() { Success = (err == nil) }()
+
+	before, err := Sh.StoredEntry(TestFile)
+
+	if err != nil || before == nil {
+		t.Error("Could not retrieve index entry: ", err)
+		return
+	}
+
+	err = Sh.StoreEntry(before)
+
+	if err != nil {
+		t.Error("Could not store index entry: ", err)
+		return
+	}
+
+	var changed []*FileEntry
+
+	err = Sh.ForEachEntry(before.Sequence, func(e *FileEntry) error {
+		changed = append(changed, e)
+		return nil
+	})
+
+	if err != nil {
+		t.Error("Could not list changed entries: ", err)
+		return
+	}
+
+	if len(changed) != 1 || changed[0].Path != TestFile ||
+		changed[0].Sequence <= before.Sequence {
+		t.Error("Stored entry not listed as changed: ", changed)
+	}
+}
+
+func TestSequenceAfterCollect(t *testing.T) {
+	s, cleanup := TempIndexedShare(t)
+	defer cleanup()
+
+	for _, file := range []string{"a", "b"} {
+		err := s.StoreEntry(&FileEntry{Path: file, Hash: []byte(file)})
+
+		if err != nil {
+			t.Fatal("Could not store index entry: ", err)
+		}
+	}
+
+	_, err := s.Tombstone("b", nil)
+
+	if err != nil {
+		t.Fatal("Could not record removal: ", err)
+	}
+
+	acked, _ := s.MaxSequence()
+	s.StorePeerAck("peer", acked)
+
+	if collected, err := s.CollectTombstones(time.Now().Unix() + 1); collected != 1 {
+		t.Fatal("Removal not collected: ", collected, err)
+	}
+
+	if last, _ := s.MaxSequence(); last != acked {
+		t.Error("Sequence went back after collecting: ", last, acked)
+	}
+
+	s.StoreEntry(&FileEntry{Path: "c", Hash: []byte("c")})
+
+	var changed []string
+
+	s.ForEachEntry(acked, func(e *FileEntry) error {
+		changed = append(changed, e.Path)
+		return nil
+	})
+
+	if len(changed) != 1 || changed[0] != "c" {
+		t.Error("New file not listed after the acknowledged sequence: ", changed)
+	}
+}
+
+func TestTombstoneKnownPeers(t *testing.T) {
+	s, cleanup := TempIndexedShare(t)
+	defer cleanup()
+
+	s.Config.AuthorizedClients = []string{"absent-peer"}
+
+	s.StoreEntry(&FileEntry{Path: "removed", Hash: []byte("removed")})
+
+	_, err := s.Tombstone("removed", nil)
+
+	if err != nil {
+		t.Fatal("Could not record removal: ", err)
+	}
+
+	if collected, err := s.CollectTombstones(time.Now().Unix() + 1); collected != 0 {
+		t.Fatal("Removal collected before an allowed peer saw it: ", collected, err)
+	}
+
+	acked, _ := s.MaxSequence()
+	s.StorePeerAck("absent-peer", acked)
+
+	if collected, err := s.CollectTombstones(time.Now().Unix() + 1); collected != 1 {
+		t.Error("Acknowledged removal not collected: ", collected, err)
+	}
+}
+
+func TestTreeHash(t *testing.T) {
+	if !Success || Sh == nil {
+		t.Skip("Previous test failed can't test this!")
+	}
+
+	var err error
+
+	defer func() { Success = (err == nil) }()
+
+	before, err := Sh.TreeHash(TreeRoot)
+
+	if err != nil || before == nil {
+		t.Error("Could not hash share root: ", err)
+		return
+	}
+
+	entry, err := Sh.StoredEntry(TestFile)
+
+	if err != nil || entry == nil {
+		t.Error("Could not retrieve index entry: ", err)
+		return
+	}
+
+	entry.Vector = entry.Vector.Increment("tree-test")
+
+	err = Sh.StoreEntry(entry)
+
+	if err != nil {
+		t.Error("Could not store index entry: ", err)
+		return
+	}
+
+	after, err := Sh.TreeHash(TreeRoot)
+
+	if err != nil || bytes.Equal(before, after) {
+		t.Error("Root hash not updated after a change: ", err)
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	if !Success || Sh == nil {
+		t.Skip("Previous test failed can't test this!")
+	}
+
+	var err error
+
+	defer func() { Success = (err == nil) }()
+
+	err = Sh.Remove(TestFile, nil)
+
+	if err != nil {
+		t.Error("Could not remove test file: ", err)
+		return
+	}
+
+	entry, err := Sh.StoredEntry(TestFile)
+
+	if err != nil || entry == nil || !entry.Deleted {
+		t.Error("Removal not recorded in the index: ", err)
+		return
+	}
+
+	if leaf, _ := Sh.TreeHash(TestFile); leaf != nil {
+		t.Error("Removed file still in the tree!")
+	}
+
+	//No peer ever entered the share, nothing keeps the removal around
+	collected, err := Sh.CollectTombstones(entry.ModTime + 1)
+
+	if err != nil || collected != 1 {
+		t.Error("Removal not collected: ", collected, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{"a/b", "c", MetaDirName} {
+		os.MkdirAll(path.Join(dir, d), 0755)
+	}
+
+	ioutil.WriteFile(path.Join(dir, "a", "file"), []byte("content"), 0644)
+
+	w, err := fsnotify.NewWatcher()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer w.Close()
+
+	s := &Share{
+		Path:       dir,
+		Watcher:    w,
+		watched:    make(map[string]bool),
+		watchMutex: &sync.Mutex{},
+	}
+
+	err = s.Watch(dir)
+
+	if err != nil {
+		t.Fatal("Could not watch share: ", err)
+	}
+
+	if len(s.watched) != 4 || !s.watched[path.Join(dir, "a", "b")] ||
+		s.watched[path.Join(dir, MetaDirName)] {
+		t.Error("Unexpected watched folders: ", s.watched)
+	}
+
+	s.Unwatch(path.Join(dir, "a"))
+
+	if len(s.watched) != 2 || s.watched[path.Join(dir, "a", "b")] {
+		t.Error("Folders still watched after removal: ", s.watched)
+	}
+}
+
+func TestFromOffline(t *testing.T) {
+	if !Success || Sh == nil {
+		t.Skip("Previous test failed can't test this!")
+	}
+
+	var err error
+
+	defer func() { Success = (err == nil) }()
+
+	err = os.MkdirAll(path.Join(ShareDir, "offline"), 0755)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	file := path.Join("offline", "file")
+
+	err = ioutil.WriteFile(path.Join(ShareDir, file), []byte("offline"), 0644)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer os.RemoveAll(path.Join(ShareDir, "offline"))
+
+	report, err := Sh.FromOffline()
+
+	if err != nil {
+		t.Error("Could not look for offline changes: ", err)
+		return
+	}
+
+	found := false
+
+	for _, e := range append(report.Created, report.Modified...) {
+		found = found || e.Path == file
+	}
+
+	if !found {
+		t.Error("File created offline not reported: ", report)
+	}
+
+	report, err = Sh.FromOffline()
+
+	if err != nil || report.Len() != 0 {
+		t.Error("Changes reported twice: ", report, err)
+	}
 }
@@ -1,13 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
 	"lightsync/proto"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	//Maximum number of operations sent in a single DeltaData
+	deltaMaxOps int = 1024
 )
 
 type ShareHandler struct {
 	Share
 	requestChannel chan Message
 	controlChannel chan int
+	peerChannel    chan *Client
+
+	transfers map[string]*transfer
+	deltas    map[string]*deltaTransfer
+	renames   *renameDetector
+	debouncer *eventDebouncer
+	applied   map[string]*remoteWrite
+
+	violations map[string]int //Paths leaving the share sent by each peer
+
+	batches map[string][]*indexBatch //Index batches of each peer still being pulled
+	walks   map[string]*treeWalk     //Tree comparisons we started with each peer
 }
 
 func NewShareHandler(share Share, out chan Message) (sh *ShareHandler) {
@@ -15,6 +37,15 @@ func NewShareHandler(share Share, out chan Message) (sh *ShareHandler) {
 		Share:          share,
 		requestChannel: out,
 		controlChannel: make(chan int),
+		peerChannel:    make(chan *Client, 10),
+		transfers:      make(map[string]*transfer),
+		deltas:         make(map[string]*deltaTransfer),
+		renames:        newRenameDetector(),
+		debouncer:      newEventDebouncer(share.QuietPeriod(), share.MaxEventDelay()),
+		applied:        make(map[string]*remoteWrite),
+		violations:     make(map[string]int),
+		batches:        make(map[string][]*indexBatch),
+		walks:          make(map[string]*treeWalk),
 	}
 
 	go sh.handleLocal()
@@ -26,24 +57,69 @@ func (sh *ShareHandler) HandOver(msg Message) {
 	sh.requestChannel <- msg
 }
 
+/**
+ * Tells the handler that the handshake with peer completed, it enters the
+ * share if peer is allowed to take part in it
+ **/
+func (sh *ShareHandler) PeerConnected(peer *Client) {
+	sh.peerChannel <- peer
+}
+
 func (sh *ShareHandler) handleLocal() {
 	defer sh.Share.Watcher.Close()
 
+	report, err := sh.FromOffline()
+
+	if err != nil {
+		LogObj.Println("Could not look for offline changes of share", sh.Name, ":", err)
+	} else if report.Len() > 0 {
+		LogObj.Println("Found", report.Len(), "offline changes in share", sh.Name)
+		sh.AnnounceReport(report)
+	}
+
+	ticker := time.NewTicker(renameWindow)
+	defer ticker.Stop()
+
+	rescan := time.NewTicker(sh.RescanInterval())
+	defer rescan.Stop()
+
 	for {
+		var flush <-chan time.Time
+
+		if wait, ok := sh.debouncer.Next(time.Now()); ok {
+			flush = time.After(wait)
+		}
+
 		select {
 		case evt := <-sh.Events():
-			//Event
-			LogObj.Println("event: ", evt)
-			break
+			sh.debouncer.Add(evt, time.Now())
+
+		case now := <-flush:
+			for _, evt := range sh.debouncer.Ready(now) {
+				sh.HandleEvent(evt, now)
+			}
+
+		case now := <-ticker.C:
+			sh.expireRenames(now)
+			sh.expireEchoes(now)
+
+		case <-rescan.C:
+			sh.Rescan()
 
 		case err := <-sh.Errors():
-			//Error
-			LogObj.Println("error: ", err)
+			//Events may have been lost, look for what changed
+			LogObj.Println("Watcher error on share", sh.Name, ":", err)
+			sh.Rescan()
 
 		case <-sh.controlChannel:
 			LogObj.Println("ShareHandler ", sh.Name, " stopping!")
 			return
 
+		case peer := <-sh.peerChannel:
+			if sh.Authorized(peer) && !sh.HasClient(peer) {
+				sh.Enter(peer)
+			}
+
 		case msg := <-sh.requestChannel:
 			LogObj.Println("Handling message")
 			sh.Handle(msg)
@@ -57,22 +133,40 @@ func (sh *ShareHandler) HandleFile(msg *FileMessageWrapper) {
 		return
 	}
 
+	if sh.Ignored(msg.GetFilename(), msg.GetFolder()) {
+		return
+	}
+
 	switch msg.GetAction() {
 	case light.FileAction_REMOVED:
-		sh.Remove(msg.GetFilename())
+		if msg.GetFolder() {
+			sh.ExpectRemoval(msg.GetFilename())
+
+			//Files of ours the peer did not have yet are kept along with it
+			if err := sh.Remove(msg.GetFilename(), nil); err != nil {
+				LogObj.Println("Could not remove folder", msg.GetFilename(), ":", err)
+			}
+		} else {
+			sh.HandleUpdate(msg)
+		}
 
 	case light.FileAction_CREATED:
 		if msg.GetFolder() {
-			sh.CreateDir(msg.GetFilename())
+			sh.ExpectFolder(msg.GetFilename())
+			sh.CreateDir(msg.GetFilename(), msg.Mode)
 		} else {
 			sh.CreateFile(msg.GetFilename())
 		}
 
 	case light.FileAction_UPDATED:
-		sh.CheckHash(msg.GetFilename(), msg.GetHash())
+		sh.HandleUpdate(msg)
+
+	case light.FileAction_RENAMED:
+		sh.HandleRename(msg)
 
 	default:
-		panic("Invalid enum value in FileMessage!")
+		LogObj.Println("Dropping file message with unknown action", msg.GetAction(),
+			"from", msg.Sender().Name())
 	}
 }
 
@@ -84,10 +178,15 @@ func (sh *ShareHandler) HandleShare(msg *ShareMessageWrapper) {
 
 	switch msg.GetAction() {
 	case light.ShareAction_LEAVING:
+		sh.SuspendTransfers(msg.Sender())
 		sh.RemoveClient(msg.Sender())
 
 	case light.ShareAction_ENTERING:
-		sh.AddClient(msg.Sender())
+		if !sh.HasClient(msg.Sender()) {
+			sh.Enter(msg.Sender())
+		}
+
+		sh.SendIndex(msg.Sender(), msg.GetIndexId(), msg.GetSince())
 	}
 }
 
@@ -99,7 +198,788 @@ func (sh *ShareHandler) HandlePeer(msg *PeerMessageWrapper) {
 	}
 }
 
+func (sh *ShareHandler) HandleUpdate(msg *FileMessageWrapper) {
+	sh.Reconcile(msg.Sender(), &FileEntry{
+		Path:    msg.GetFilename(),
+		Hash:    msg.GetHash(),
+		ModTime: msg.GetMtime(),
+		Vector:  VersionVectorFromProto(msg.GetVersion()),
+		Deleted: msg.GetAction() == light.FileAction_REMOVED,
+		Target:  targetFromProto(msg.GetType(), msg.GetTarget()),
+		Mode:    msg.GetMode(),
+		HasMode: msg.Mode != nil,
+		Uid:     msg.GetUid(),
+		Gid:     msg.GetGid(),
+		Xattrs:  xattrsFromProto(msg.GetXattrs()),
+	})
+}
+
+/**
+ * Compares the version of a file announced by peer with ours to decide
+ * whether to fetch it, remove it, ignore it or report a conflict
+ **/
+func (sh *ShareHandler) Reconcile(peer *Client, remote *FileEntry) {
+	file := remote.Path
+
+	if sh.Ignored(file, false) {
+		return
+	}
+
+	//Make sure local changes not indexed yet are taken into account
+	if modified, err := sh.CheckFileShallow(file); err == nil && modified {
+		sh.CheckFileDeep(file)
+	}
+
+	entry, err := sh.StoredEntry(file)
+
+	if err != nil {
+		LogObj.Println("Could not read index entry of", file, ":", err)
+		return
+	}
+
+	if entry == nil {
+		if remote.Deleted {
+			return
+		}
+
+		entry = &FileEntry{Path: file, Deleted: true}
+	}
+
+	if remote.Deleted {
+		sh.reconcileRemoval(peer, entry, remote)
+		return
+	}
+
+	if !entry.Deleted && bytes.Equal(entry.Hash, remote.Hash) &&
+		entry.Target == remote.Target {
+		sh.reconcileMetadata(peer, entry, remote)
+		return
+	}
+
+	switch remote.Vector.Compare(entry.Vector) {
+	case VersionNewer:
+		sh.fetchVersion(peer, remote, remote.Vector)
+
+	case VersionOlder:
+		LogObj.Println("Ignoring outdated version of", file, "from", peer.Name())
+
+	default:
+		if entry.Deleted {
+			//A modification always wins over a concurrent removal
+			sh.fetchVersion(peer, remote, remote.Vector.Merge(entry.Vector))
+			return
+		}
+
+		//Same version with a different content is a conflict as well
+		sh.HandleConflict(peer, entry, remote)
+	}
+}
+
+func (sh *ShareHandler) reconcileRemoval(peer *Client, local, remote *FileEntry) {
+	file := local.Path
+
+	if remote.Vector.Compare(local.Vector) != VersionNewer {
+		if !local.Deleted {
+			//Our copy was modified since, the peer will fetch it back
+			LogObj.Println("Ignoring removal of", file, "from", peer.Name())
+		}
+		return
+	}
+
+	if !local.Deleted {
+		LogObj.Println("Removing", file, "as removed by", peer.Name())
+	}
+
+	sh.ExpectRemoval(file)
+
+	err := sh.Remove(file, remote.Vector)
+
+	if err != nil {
+		LogObj.Println("Could not remove", file, ":", err)
+	}
+}
+
+/**
+ * Called when a peer announces a version of file concurrent to ours.
+ * Only the losing side acts: it fetches the winning version, keeping its own
+ * as a conflict copy when the policy asks for it
+ **/
+func (sh *ShareHandler) HandleConflict(peer *Client, local, remote *FileEntry) {
+	file, policy := local.Path, sh.Config.ConflictPolicy
+
+	if !sh.RemoteWins(local, remote.ModTime, peer.Name()) {
+		LogObj.Println("Conflict on", file, "with", peer.Name(), "(", policy,
+			"): keeping local version", local.Vector)
+		return
+	}
+
+	LogObj.Println("Conflict on", file, "with", peer.Name(), "(", policy,
+		"): taking remote version", remote.Vector)
+
+	if policy == ConflictKeepBoth {
+		copyName := ConflictFileName(file, time.Now(), LocalFingerprint)
+
+		//Our copy stays in place, and keeps its blocks, until the remote
+		//version is committed over it
+		err := sh.CopyFile(file, copyName)
+
+		if err != nil {
+			LogObj.Println("Could not keep conflicting", file, ":", err)
+			return
+		}
+
+		LogObj.Println("Local version of", file, "kept as", copyName)
+
+		//Peers get our version under its new name
+		sh.localChange(copyName)
+	}
+
+	//Our version is superseded by the remote one
+	sh.fetchVersion(peer, remote, remote.Vector.Merge(local.Vector))
+}
+
+/**
+ * Starts fetching the content of remote, the entry of a file on peer, to
+ * store it with version vector. A delta against our copy is requested when
+ * we have one and the peer supports it, the whole block list otherwise.
+ * Partial downloads can only be resumed block by block
+ **/
+func (sh *ShareHandler) RequestUpdate(peer *Client, remote *FileEntry,
+	vector VersionVector) {
+
+	file := remote.Path
+
+	stat, err := os.Stat(path.Join(sh.Path, file))
+
+	partial, _ := sh.StoredPartial(file)
+
+	if err != nil || stat.Size() == 0 || partial != nil ||
+		DeltaBlockSizeFor(stat.Size()) == 0 ||
+		peer == nil || !peer.HasFeature(FeatureDeltaSync) {
+		sh.RequestBlockList(peer, remote, vector)
+	} else {
+		sh.RequestDelta(peer, remote, vector)
+	}
+}
+
+/**
+ * Starts pulling remote from peer by asking for its block list
+ **/
+func (sh *ShareHandler) RequestBlockList(peer *Client, remote *FileEntry,
+	vector VersionVector) {
+
+	file, hash := remote.Path, remote.Hash
+
+	if peer == nil {
+		LogObj.Println("No peer to fetch", file, "from")
+		return
+	}
+
+	if old, pending := sh.transfers[file]; pending {
+		old.Suspend()
+	}
+
+	sh.transfers[file] = newTransfer(peer, remote, vector)
+
+	peer.WriteMessage(&ChunkRequestWrapper{MessageWrapper{nil},
+		&light.ChunkRequest{
+			Filename:  proto.String(file),
+			ShareName: proto.String(sh.Name),
+			Hash:      hash,
+		}})
+}
+
+func (sh *ShareHandler) HandleChunkRequest(msg *ChunkRequestWrapper) {
+	if msg.GetShareName() != sh.Name {
+		LogObj.Println("Ignoring message meant for share", msg.GetShareName())
+		return
+	}
+
+	file, peer := msg.GetFilename(), msg.Sender()
+
+	entry, err := sh.StoredEntry(file)
+
+	if err != nil || entry == nil || entry.Deleted {
+		LogObj.Println("Peer", peer.Name(), "requested unknown file", file)
+		return
+	}
+
+	if len(msg.GetChunks()) != 0 && bytes.Equal(msg.GetHash(), entry.Hash) {
+		//Reading and sending every chunk takes a while, other messages go on
+		go sh.sendChunks(peer, file, entry.Hash, msg.GetChunks())
+		return
+	}
+
+	if len(msg.GetChunks()) != 0 {
+		//Our chunks would not match, the peer starts over from our block list
+		LogObj.Println("Peer", peer.Name(), "requested chunks of another version of", file)
+	}
+
+	blocks, err := sh.StoredBlocks(file)
+
+	if err != nil {
+		LogObj.Println("Could not read block hashes of", file, ":", err)
+		return
+	}
+
+	peer.WriteMessage(&BlockListWrapper{MessageWrapper{nil},
+		&light.BlockList{
+			Filename:  proto.String(file),
+			ShareName: proto.String(sh.Name),
+			Hash:      entry.Hash,
+			Size:      proto.Int64(entry.Size),
+			Blocks:    blocks,
+		}})
+}
+
+/**
+ * Sends peer the chunks of file, whose indexed content hashes to hash. Runs
+ * apart from the handler so only reads the share. A file changed meanwhile
+ * is caught by the peer when verifying the chunks
+ **/
+func (sh *ShareHandler) sendChunks(peer *Client, file string, hash []byte, chunks []int64) {
+	for _, c := range chunks {
+		data, err := sh.ReadChunk(file, c)
+
+		if err != nil {
+			LogObj.Println("Could not read chunk", c, "of", file, ":", err)
+			return
+		}
+
+		peer.WriteMessage(&ChunkDataWrapper{MessageWrapper{nil},
+			&light.ChunkData{
+				Filename:  proto.String(file),
+				ShareName: proto.String(sh.Name),
+				Hash:      hash,
+				Chunk:     proto.Int64(c),
+				Data:      data,
+			}})
+	}
+}
+
+func (sh *ShareHandler) HandleBlockList(msg *BlockListWrapper) {
+	if msg.GetShareName() != sh.Name {
+		LogObj.Println("Ignoring message meant for share", msg.GetShareName())
+		return
+	}
+
+	file := msg.GetFilename()
+
+	t, pending := sh.transfers[file]
+
+	if !pending || t.peer != msg.Sender() {
+		LogObj.Println("Ignoring unrequested block list for", file)
+		return
+	}
+
+	size, blocks := msg.GetSize(), msg.GetBlocks()
+
+	//Every chunk is verified against the hash of its block
+	if size < 0 || size > MaxTransferSize ||
+		int64(len(blocks)) != ChunkCount(size) {
+		LogObj.Println("Invalid block list for", file, "from", t.peer.Name())
+		sh.abortTransfer(file, t)
+		return
+	}
+
+	//The peer may have a newer version than the one announced
+	t.hash, t.size = msg.GetHash(), size
+	t.blocks = blocks
+	t.missing = make(map[int64]bool)
+
+	t.Suspend()
+	t.out = nil
+
+	err := sh.resumePartial(file, t)
+
+	if err == nil && t.out == nil {
+		err = sh.startPartial(file, t)
+	}
+
+	if err != nil {
+		LogObj.Println("Could not prepare", file, "for transfer:", err)
+		sh.abortTransfer(file, t)
+		return
+	}
+
+	if t.Done() {
+		sh.finishTransfer(file, t)
+		return
+	}
+
+	t.peer.WriteMessage(&ChunkRequestWrapper{MessageWrapper{nil},
+		&light.ChunkRequest{
+			Filename:  proto.String(file),
+			ShareName: proto.String(sh.Name),
+			Hash:      t.hash,
+			Chunks:    t.Chunks(),
+		}})
+}
+
+func (sh *ShareHandler) HandleChunkData(msg *ChunkDataWrapper) {
+	if msg.GetShareName() != sh.Name {
+		LogObj.Println("Ignoring message meant for share", msg.GetShareName())
+		return
+	}
+
+	file, chunk := msg.GetFilename(), msg.GetChunk()
+
+	t, pending := sh.transfers[file]
+
+	if !pending || !bytes.Equal(t.hash, msg.GetHash()) || !t.missing[chunk] {
+		LogObj.Println("Ignoring stale chunk", chunk, "of", file)
+		return
+	}
+
+	if !t.VerifyChunk(chunk, msg.GetData()) {
+		LogObj.Println("Chunk", chunk, "of", file, "is corrupted, requesting it again")
+
+		t.peer.WriteMessage(&ChunkRequestWrapper{MessageWrapper{nil},
+			&light.ChunkRequest{
+				Filename:  proto.String(file),
+				ShareName: proto.String(sh.Name),
+				Hash:      t.hash,
+				Chunks:    []int64{chunk},
+			}})
+		return
+	}
+
+	err := t.WriteChunk(chunk, msg.GetData())
+
+	if err != nil {
+		LogObj.Println("Could not write chunk", chunk, "of", file, ":", err)
+		sh.abortTransfer(file, t)
+		return
+	}
+
+	delete(t.missing, chunk)
+
+	err = sh.StorePartialBlock(file, chunk)
+
+	if err != nil {
+		LogObj.Println("Could not record chunk", chunk, "of", file, ":", err)
+	}
+
+	if t.Done() {
+		sh.finishTransfer(file, t)
+	}
+}
+
+/**
+ * Sends the signature of our copy of remote to peer so that it answers with
+ * the delta to apply
+ **/
+func (sh *ShareHandler) RequestDelta(peer *Client, remote *FileEntry,
+	vector VersionVector) {
+
+	file, hash := remote.Path, remote.Hash
+
+	if peer == nil {
+		LogObj.Println("No peer to fetch", file, "from")
+		return
+	}
+
+	if old, pending := sh.deltas[file]; pending {
+		old.Abort()
+		delete(sh.deltas, file)
+	}
+
+	basis, err := sh.OpenFile(file)
+
+	if err != nil {
+		LogObj.Println("Could not open", file, "for delta:", err)
+		return
+	}
+
+	stat, err := basis.Stat()
+
+	if err != nil || DeltaBlockSizeFor(stat.Size()) == 0 {
+		//Too large for its signature to be sent
+		basis.Close()
+		sh.RequestBlockList(peer, remote, vector)
+		return
+	}
+
+	sig, err := ComputeSignature(basis, DeltaBlockSizeFor(stat.Size()))
+
+	if err != nil {
+		LogObj.Println("Could not compute signature of", file, ":", err)
+		basis.Close()
+		return
+	}
+
+	out, err := sh.TempFile(deltaPrefix)
+
+	if err != nil {
+		LogObj.Println("Could not create temporary file for", file, ":", err)
+		basis.Close()
+		return
+	}
+
+	sh.deltas[file] = &deltaTransfer{
+		transfer: transfer{
+			peer:   peer,
+			hash:   hash,
+			vector: vector,
+			meta:   remote,
+			out:    out,
+		},
+		blockSize: sig.BlockSize,
+		basis:     basis,
+	}
+
+	req := &light.DeltaRequest{
+		Filename:  proto.String(file),
+		ShareName: proto.String(sh.Name),
+		Hash:      hash,
+		BlockSize: proto.Int32(int32(sig.BlockSize)),
+	}
+
+	for _, b := range sig.Blocks {
+		req.Weak = append(req.Weak, b.Weak)
+		req.Strong = append(req.Strong, b.Strong)
+	}
+
+	peer.WriteMessage(&DeltaRequestWrapper{MessageWrapper{nil}, req})
+}
+
+func (sh *ShareHandler) HandleDeltaRequest(msg *DeltaRequestWrapper) {
+	if msg.GetShareName() != sh.Name {
+		LogObj.Println("Ignoring message meant for share", msg.GetShareName())
+		return
+	}
+
+	file, peer := msg.GetFilename(), msg.Sender()
+
+	entry, err := sh.StoredEntry(file)
+
+	if err != nil || entry == nil || entry.Deleted {
+		LogObj.Println("Peer", peer.Name(), "requested delta of unknown file", file)
+		return
+	}
+
+	if len(msg.GetWeak()) != len(msg.GetStrong()) {
+		LogObj.Println("Invalid signature for", file, "from", peer.Name())
+		return
+	}
+
+	sig := &Signature{BlockSize: int(msg.GetBlockSize())}
+
+	for i, weak := range msg.GetWeak() {
+		sig.Blocks = append(sig.Blocks, BlockSignature{weak, msg.GetStrong()[i]})
+	}
+
+	//Rolling over the whole file takes a while, other messages go on
+	go sh.sendDelta(peer, file, entry.Hash, sig)
+}
+
+/**
+ * Sends peer the delta turning the copy of file it signed with sig into
+ * ours, whose indexed content hashes to hash. Runs apart from the handler
+ * like sendChunks
+ **/
+func (sh *ShareHandler) sendDelta(peer *Client, file string, hash []byte, sig *Signature) {
+	fd, err := sh.OpenFile(file)
+
+	if err != nil {
+		LogObj.Println("Could not open", file, "for delta:", err)
+		return
+	}
+
+	defer fd.Close()
+
+	newData := func() *light.DeltaData {
+		return &light.DeltaData{
+			Filename:  proto.String(file),
+			ShareName: proto.String(sh.Name),
+			Hash:      hash,
+		}
+	}
+
+	data, literal := newData(), 0
+
+	err = ComputeDelta(sig, fd, func(op DeltaOp) error {
+		pb := &light.DeltaOp{}
+
+		if op.Block < 0 {
+			pb.Literal = op.Literal
+			literal += len(op.Literal)
+		} else {
+			pb.Block = proto.Int64(op.Block)
+		}
+
+		data.Ops = append(data.Ops, pb)
+
+		if int64(literal) >= FileChunkSize || len(data.Ops) >= deltaMaxOps {
+			peer.WriteMessage(&DeltaDataWrapper{MessageWrapper{nil}, data})
+			data, literal = newData(), 0
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		LogObj.Println("Could not compute delta of", file, ":", err)
+		return
+	}
+
+	data.Last = proto.Bool(true)
+
+	peer.WriteMessage(&DeltaDataWrapper{MessageWrapper{nil}, data})
+}
+
+func (sh *ShareHandler) HandleDeltaData(msg *DeltaDataWrapper) {
+	if msg.GetShareName() != sh.Name {
+		LogObj.Println("Ignoring message meant for share", msg.GetShareName())
+		return
+	}
+
+	file := msg.GetFilename()
+
+	t, pending := sh.deltas[file]
+
+	if !pending || t.peer != msg.Sender() {
+		LogObj.Println("Ignoring unrequested delta for", file)
+		return
+	}
+
+	if !t.started {
+		//The peer may have a newer version than the one announced
+		t.hash, t.started = msg.GetHash(), true
+	} else if !bytes.Equal(t.hash, msg.GetHash()) {
+		LogObj.Println("Content of", file, "changed during delta transfer")
+		t.Abort()
+		delete(sh.deltas, file)
+		return
+	}
+
+	ops := make([]DeltaOp, len(msg.GetOps()))
+
+	for i, op := range msg.GetOps() {
+		if op.Block != nil {
+			ops[i] = DeltaOp{Block: op.GetBlock()}
+		} else {
+			ops[i] = DeltaOp{Block: -1, Literal: op.GetLiteral()}
+		}
+	}
+
+	err := ApplyDelta(t.basis, t.blockSize, ops, t.out)
+
+	if err != nil {
+		LogObj.Println("Could not apply delta to", file, ":", err)
+		t.Abort()
+		delete(sh.deltas, file)
+		return
+	}
+
+	if msg.GetLast() {
+		sh.finishDelta(file, t)
+	}
+}
+
+func (sh *ShareHandler) finishDelta(file string, t *deltaTransfer) {
+	delete(sh.deltas, file)
+
+	t.basis.Close()
+
+	sh.commitTransfer(file, &t.transfer)
+}
+
+/**
+ * Reopens the partial download of file left by a previous transfer if it
+ * holds the content t is fetching, otherwise it is dropped
+ **/
+func (sh *ShareHandler) resumePartial(file string, t *transfer) error {
+	p, err := sh.StoredPartial(file)
+
+	if err != nil || p == nil {
+		return err
+	}
+
+	if !bytes.Equal(p.Hash, t.hash) || p.Size != t.size {
+		LogObj.Println("Dropping outdated partial download of", file)
+		return sh.RemovePartial(file)
+	}
+
+	t.out, err = sh.OpenPartial(p.Temp)
+
+	if err != nil {
+		LogObj.Println("Could not resume transfer of", file, ":", err)
+		t.out = nil
+		return sh.RemovePartial(file)
+	}
+
+	t.vector = t.vector.Merge(p.Vector)
+
+	for c := int64(0); c < ChunkCount(t.size); c++ {
+		if !p.Blocks[c] {
+			t.missing[c] = true
+		}
+	}
+
+	LogObj.Println("Resuming transfer of", file, ",", len(t.missing), "chunks left")
+
+	return nil
+}
+
+/**
+ * Starts a new partial download of file, only the blocks differing from our
+ * copy are missing
+ **/
+func (sh *ShareHandler) startPartial(file string, t *transfer) (err error) {
+	local, err := sh.StoredBlocks(file)
+
+	if err != nil {
+		return
+	}
+
+	remote := t.blocks
+
+	t.out, err = sh.NewPartial(file, t.size)
+
+	if err != nil {
+		return
+	}
+
+	for _, c := range DiffBlocks(local, remote) {
+		t.missing[c] = true
+	}
+
+	p := &PartialEntry{
+		Path:   file,
+		Temp:   path.Base(t.out.Name()),
+		Hash:   t.hash,
+		Size:   t.size,
+		Vector: t.vector,
+		Blocks: make(map[int64]bool),
+		Peer:   t.peer.Name(),
+		Meta:   t.meta,
+	}
+
+	for c := int64(0); c < ChunkCount(t.size); c++ {
+		if !t.missing[c] {
+			p.Blocks[c] = true
+		}
+	}
+
+	//Transfer can go on without being resumable
+	sh.StorePartial(p)
+
+	return nil
+}
+
+/**
+ * Asks peer again for the block list of every partial download it was the
+ * source of, the transfers going on from the blocks we already have
+ **/
+func (sh *ShareHandler) ResumeTransfers(peer *Client) {
+	files, err := sh.PartialsFrom(peer.Name())
+
+	if err != nil {
+		LogObj.Println("Could not read partial downloads of share", sh.Name, ":", err)
+		return
+	}
+
+	for _, file := range files {
+		if _, pending := sh.transfers[file]; pending {
+			continue
+		}
+
+		p, err := sh.StoredPartial(file)
+
+		if err != nil || p == nil {
+			continue
+		}
+
+		LogObj.Println("Resuming transfer of", file, "from", peer.Name())
+
+		//The metadata announced with the file is applied once complete
+		sh.RequestBlockList(peer, p.Meta, p.Vector)
+	}
+}
+
+/**
+ * Stops every transfer from peer, keeping partial downloads for later
+ **/
+func (sh *ShareHandler) SuspendTransfers(peer *Client) {
+	for file, t := range sh.transfers {
+		if t.peer == peer {
+			LogObj.Println("Suspending transfer of", file)
+			t.Suspend()
+			delete(sh.transfers, file)
+		}
+	}
+
+	for file, t := range sh.deltas {
+		if t.peer == peer {
+			t.Abort()
+			delete(sh.deltas, file)
+		}
+	}
+}
+
+func (sh *ShareHandler) abortTransfer(file string, t *transfer) {
+	t.Abort()
+	sh.RemovePartial(file)
+	delete(sh.transfers, file)
+}
+
+func (sh *ShareHandler) finishTransfer(file string, t *transfer) {
+	delete(sh.transfers, file)
+
+	sh.commitTransfer(file, t)
+	sh.RemovePartial(file)
+}
+
+/**
+ * Moves the assembled content of a finished transfer into place once its
+ * hash is verified and records the version it came with
+ **/
+func (sh *ShareHandler) commitTransfer(file string, t *transfer) {
+	sh.ExpectFile(file, t.hash)
+
+	err := sh.CommitPartial(t.out, file, t.hash)
+
+	if err == ErrLocalChange {
+		//Announced once indexed, the peer decides then like for a conflict
+		LogObj.Println("Dropping transfer of", file, "changed locally meanwhile")
+		return
+	}
+
+	if err != nil {
+		LogObj.Println("Could not replace", file, "after transfer:", err)
+		return
+	}
+
+	err = sh.ApplyMetadata(file, t.meta)
+
+	if err != nil {
+		LogObj.Println("Could not apply metadata of", file, ":", err)
+	}
+
+	_, err = sh.IndexFile(file, t.vector)
+
+	if err != nil {
+		LogObj.Println("Could not index", file, "after transfer:", err)
+		return
+	}
+
+	LogObj.Println("Transfer of", file, "from", t.peer.Name(), "complete")
+
+	sh.fetched(t.peer, file)
+}
+
 func (sh *ShareHandler) Handle(msg Message) {
+	//Covers every handler: nothing is read, written or sent for other peers
+	if !sh.Authorized(msg.Sender()) {
+		LogObj.Println("Dropping message from peer not allowed in share", sh.Name)
+		return
+	}
+
+	if !sh.acceptPaths(msg) {
+		return
+	}
+
 	switch msg.(type) {
 	case *PeerMessageWrapper:
 		sh.HandlePeer(msg.(*PeerMessageWrapper))
@@ -110,13 +990,44 @@ func (sh *ShareHandler) Handle(msg Message) {
 	case *FileMessageWrapper:
 		sh.HandleFile(msg.(*FileMessageWrapper))
 
+	case *BlockListWrapper:
+		sh.HandleBlockList(msg.(*BlockListWrapper))
+
+	case *ChunkRequestWrapper:
+		sh.HandleChunkRequest(msg.(*ChunkRequestWrapper))
+
+	case *ChunkDataWrapper:
+		sh.HandleChunkData(msg.(*ChunkDataWrapper))
+
+	case *DeltaRequestWrapper:
+		sh.HandleDeltaRequest(msg.(*DeltaRequestWrapper))
+
+	case *DeltaDataWrapper:
+		sh.HandleDeltaData(msg.(*DeltaDataWrapper))
+
+	case *IndexMessageWrapper:
+		sh.HandleIndex(msg.(*IndexMessageWrapper))
+
+	case *TreeMessageWrapper:
+		sh.HandleTree(msg.(*TreeMessageWrapper))
+
 	default:
-		panic("Invalid message type!!")
+		LogObj.Printf("Dropping message of unknown type %T", msg)
 	}
 }
 
+/**
+ * Tells whether the indexed content of name matches hash
+ **/
 func (sh *ShareHandler) CheckHash(name string, hash []byte) bool {
-	return true
+	stored, err := sh.StoredHash(name)
+
+	if err != nil {
+		LogObj.Println("Could not read stored hash of", name, ":", err)
+		return false
+	}
+
+	return bytes.Equal(stored, hash)
 }
 
 func (sh *ShareHandler) Stop() {
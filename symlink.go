@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"crypto/sha1"
+	"errors"
+	"lightsync/proto"
+	"os"
+	"path"
+)
+
+func isSymlink(info os.FileInfo) bool {
+	return info.Mode()&os.ModeSymlink != 0
+}
+
+/**
+ * Hash standing for the content of a symlink pointing to target
+ **/
+func linkHash(target string) []byte {
+	sum := sha1.Sum([]byte(target))
+	return sum[:]
+}
+
+/**
+ * Returns what file is indexed as: symlinks are synced as links unless the
+ * share follows them. Even then links to folders, dangling ones and the ones
+ * leaving the share are kept as links so that we never follow a link out of
+ * the share
+ **/
+func (s *Share) statFile(file string) (os.FileInfo, error) {
+	full := path.Join(s.Path, file)
+
+	stat, err := os.Lstat(full)
+
+	if err != nil || !isSymlink(stat) || !s.Config.FollowSymlinks {
+		return stat, err
+	}
+
+	if s.resolveInside(full) != nil {
+		return stat, nil
+	}
+
+	linked, err := os.Stat(full)
+
+	if err != nil || linked.IsDir() {
+		return stat, nil
+	}
+
+	return linked, nil
+}
+
+/**
+ * Hashes file, stat being what statFile returned for it
+ **/
+func (s *Share) hashFile(file string, stat os.FileInfo) (hash []byte, err error) {
+	if isSymlink(stat) {
+		target, err := os.Readlink(path.Join(s.Path, file))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return linkHash(target), nil
+	}
+
+	fd, err := s.OpenFile(file)
+
+	if err != nil {
+		return
+	}
+
+	defer fd.Close()
+
+	hash, _, err = HashBlocks(fd)
+
+	return
+}
+
+func (s *Share) indexSymlink(file string, stat os.FileInfo, vector VersionVector) (modified bool, err error) {
+	target, err := os.Readlink(path.Join(s.Path, file))
+
+	if err != nil {
+		return
+	}
+
+	return s.storeIndexed(file, stat, linkHash(target), nil, target, vector)
+}
+
+/**
+ * Replaces file by a symlink to target as sent by a peer with version vector.
+ * The target is not checked as links are never followed out of the share
+ **/
+func (s *Share) CreateSymlink(file, target string, vector VersionVector) (err error) {
+	full, err := s.parentPath(file)
+
+	if err != nil {
+		return
+	}
+
+	stat, err := os.Lstat(full)
+
+	switch {
+	case err == nil && stat.IsDir():
+		return errors.New("A folder with the name " + file + " already exists!")
+
+	case err == nil:
+		err = os.Remove(full)
+
+	case os.IsNotExist(err):
+		err = os.MkdirAll(path.Dir(full), 0755)
+	}
+
+	if err != nil {
+		return
+	}
+
+	err = os.Symlink(target, full)
+
+	if err != nil {
+		return
+	}
+
+	stat, err = os.Lstat(full)
+
+	if err != nil {
+		return
+	}
+
+	//Indexed as a link even when following links, like the peer has it
+	_, err = s.indexSymlink(file, stat, vector)
+
+	return
+}
+
+/**
+ * Type and target of the file described by e as sent to peers
+ **/
+func fileTypeToProto(e *FileEntry) (*light.FileType, *string) {
+	if e.Target == "" {
+		return nil, nil
+	}
+
+	return light.FileType_SYMLINK.Enum(), proto.String(e.Target)
+}
+
+func targetFromProto(t light.FileType, target string) string {
+	if t != light.FileType_SYMLINK {
+		return ""
+	}
+
+	return target
+}
+
+/**
+ * Brings file to the version remote of peer, merged into vector. The content
+ * of regular files is downloaded while symlinks are created right away as
+ * their target comes along with their version
+ **/
+func (sh *ShareHandler) fetchVersion(peer *Client, remote *FileEntry, vector VersionVector) {
+	file := remote.Path
+
+	if remote.Target == "" {
+		sh.RequestUpdate(peer, remote, vector)
+		return
+	}
+
+	if !bytes.Equal(remote.Hash, linkHash(remote.Target)) {
+		LogObj.Println("Ignoring symlink", file, "with an invalid hash")
+		return
+	}
+
+	if t, pending := sh.transfers[file]; pending {
+		sh.abortTransfer(file, t)
+	}
+
+	if t, pending := sh.deltas[file]; pending {
+		t.Abort()
+		delete(sh.deltas, file)
+	}
+
+	sh.ExpectFile(file, remote.Hash)
+
+	err := sh.CreateSymlink(file, remote.Target, vector)
+
+	if err != nil {
+		LogObj.Println("Could not link", file, "to", remote.Target, ":", err)
+		return
+	}
+
+	LogObj.Println("Linked", file, "to", remote.Target)
+}
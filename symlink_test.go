@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStatFile(t *testing.T) {
+	s, cleanup := TempShare(t)
+	defer cleanup()
+
+	root := s.Path
+
+	outside, err := ioutil.TempFile("", "lightsync")
+
+	if err != nil {
+		t.Fatal("Could not create test file: ", err)
+	}
+
+	outside.Close()
+	defer os.Remove(outside.Name())
+
+	ioutil.WriteFile(path.Join(root, "file"), []byte("content"), 0644)
+	os.Mkdir(path.Join(root, "dir"), 0755)
+	os.Symlink("file", path.Join(root, "in"))
+	os.Symlink("dir", path.Join(root, "folder"))
+	os.Symlink(outside.Name(), path.Join(root, "out"))
+	os.Symlink("missing", path.Join(root, "dangling"))
+
+	for _, file := range []string{"in", "folder", "out", "dangling"} {
+		stat, err := s.statFile(file)
+
+		if err != nil || !isSymlink(stat) {
+			t.Error("Link", file, "not synced as a link")
+		}
+	}
+
+	s.Config.FollowSymlinks = true
+
+	if stat, err := s.statFile("in"); err != nil || isSymlink(stat) {
+		t.Error("Link to a file of the share not followed")
+	}
+
+	for _, file := range []string{"folder", "out", "dangling"} {
+		stat, err := s.statFile(file)
+
+		if err != nil || !isSymlink(stat) {
+			t.Error("Link", file, "followed")
+		}
+	}
+}
+
+func TestSymlinkProto(t *testing.T) {
+	link := &FileEntry{Path: "link", Target: "../file"}
+	file := &FileEntry{Path: "file"}
+
+	if e := entryFromProto(entryToProto(link)); e.Target != link.Target {
+		t.Error("Target of", link.Path, "lost:", e.Target)
+	}
+
+	if pb := entryToProto(file); pb.Type != nil || pb.Target != nil {
+		t.Error("Regular file", file.Path, "sent as a symlink")
+	}
+}
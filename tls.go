@@ -78,6 +78,53 @@ func KeyFingerprint(pub *rsa.PublicKey) (fp string) {
 	return
 }
 
+/**
+ * Fingerprint of the key of the first certificate of cfg
+ **/
+func ConfigFingerprint(cfg *tls.Config) string {
+	priv, ok := cfg.Certificates[0].PrivateKey.(*rsa.PrivateKey)
+
+	if !ok {
+		return ""
+	}
+
+	return KeyFingerprint(&priv.PublicKey)
+}
+
+/**
+ * Fingerprint of the key the peer of conn proved it holds during the TLS
+ * handshake, connections without a client certificate have none
+ **/
+func PeerFingerprint(conn net.Conn) (fp string, err error) {
+	tlscon, ok := conn.(*tls.Conn)
+
+	if !ok {
+		return "", errors.New("Connection is not authenticated!")
+	}
+
+	err = tlscon.Handshake()
+
+	if err != nil {
+		return
+	}
+
+	certs := tlscon.ConnectionState().PeerCertificates
+
+	if len(certs) == 0 {
+		return "", errors.New("Peer sent no certificate!")
+	}
+
+	key, ok := certs[0].PublicKey.(*rsa.PublicKey)
+
+	if !ok {
+		return "", errors.New("Peer is not using RSA!")
+	}
+
+	fp = KeyFingerprint(key)
+
+	return
+}
+
 func NewTLSClientAccepter(config *tls.Config, accepter ClientAccepter,
 	clientAdder func (*Client)) (ln net.Listener, err error) {
 
@@ -132,8 +179,19 @@ func (t *TLSClientAccepter) AcceptConnection(conn net.Conn) {
 
 	LogObj.Println("Connection from peer", KeyFingerprint(rsaPeerKey))
 
+	hello, err := ClientHandshake(conn)
+
+	if err != nil {
+		LogObj.Println("Handshake with peer", KeyFingerprint(rsaPeerKey),
+			"failed:", err)
+		conn.Close()
+		return
+	}
+
 	c := NewClient(KeyFingerprint(rsaPeerKey), conn)
 
+	c.SetHello(hello)
+
 	t.AuthorizeClient(c)
 
 	return
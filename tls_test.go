@@ -1,8 +1,13 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
 	"log"
+	"math/big"
+	"net"
 	"os"
 	"testing"
 	"time"
@@ -44,3 +49,54 @@ func TestTLSListener(t *testing.T) {
 
 	time.Sleep(1)
 }
+
+func testCertificate(t *testing.T) (cert tls.Certificate, key *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+
+	if err != nil {
+		t.Fatal("Could not generate key: ", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal("Could not create certificate: ", err)
+	}
+
+	cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	return
+}
+
+func TestPeerFingerprint(t *testing.T) {
+	serverCert, _ := testCertificate(t)
+	clientCert, clientKey := testCertificate(t)
+
+	server, client := net.Pipe()
+	defer server.Close()
+
+	go tls.Client(client, &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientCert},
+	}).Handshake()
+
+	fp, err := PeerFingerprint(tls.Server(server, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}))
+
+	if err != nil || fp != KeyFingerprint(&clientKey.PublicKey) {
+		t.Error("Peer not named after its key: ", fp, err)
+	}
+
+	if fp, err := PeerFingerprint(server); err == nil {
+		t.Error("Session without TLS named", fp)
+	}
+}
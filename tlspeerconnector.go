@@ -89,8 +89,18 @@ func (pf *TLSPeerConnector) dial(address, port, fingerprint string) (c *Client,
 		return
 	}
 
+	hello, err := ClientHandshake(conn)
+
+	if err != nil {
+		LogObj.Println("Handshake with", conn.RemoteAddr(), "failed:", err)
+		conn.Close()
+		return
+	}
+
 	c = NewClient(fingerprint, conn)
 
+	c.SetHello(hello)
+
 	k, err := c.Key()
 
 	if err != nil {
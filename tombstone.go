@@ -0,0 +1,88 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	//How long removals are remembered once every peer knows about them
+	DefaultTombstoneRetention time.Duration = 30 * 24 * time.Hour
+)
+
+/**
+ * Marks file as removed in the index so that peers which still have it
+ * remove it as well instead of sending it back. vector is the version of
+ * the removal sent by a peer, nil if it was decided locally
+ **/
+func (s *Share) Tombstone(file string, vector VersionVector) (modified bool, err error) {
+	entry, err := s.StoredEntry(file)
+
+	if err != nil || entry == nil {
+		//Nothing to remember about a file we never had
+		return
+	}
+
+	if entry.Deleted && vector == nil {
+		return
+	}
+
+	if !entry.Deleted {
+		entry.Version++
+		entry.ModTime = time.Now().UTC().Unix()
+		modified = true
+	}
+
+	if vector != nil {
+		entry.Vector = entry.Vector.Merge(vector)
+	} else {
+		entry.Vector = entry.Vector.Increment(LocalFingerprint)
+	}
+
+	entry.Size = 0
+	entry.Hash = nil
+	entry.Deleted = true
+
+	err = s.StoreBlocks(file, nil)
+
+	if err != nil {
+		return
+	}
+
+	err = s.StoreEntry(entry)
+
+	return
+}
+
+func (s *Share) TombstoneRetention() time.Duration {
+	if s.Config.TombstoneRetention > 0 {
+		return time.Duration(s.Config.TombstoneRetention)
+	}
+
+	return DefaultTombstoneRetention
+}
+
+/**
+ * Records that peer has seen our index up to sequence and forgets the
+ * removals all peers know about
+ **/
+func (sh *ShareHandler) Acknowledge(peer *Client, sequence int64) {
+	err := sh.StorePeerAck(peer.Name(), sequence)
+
+	if err != nil {
+		LogObj.Println("Could not store acknowledgement of", peer.Name(), ":", err)
+		return
+	}
+
+	before := time.Now().Add(-sh.TombstoneRetention()).UTC().Unix()
+
+	collected, err := sh.CollectTombstones(before)
+
+	if err != nil {
+		LogObj.Println("Could not collect removed files of share", sh.Name, ":", err)
+		return
+	}
+
+	if collected > 0 {
+		LogObj.Println("Forgot", collected, "removed files of share", sh.Name)
+	}
+}
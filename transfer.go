@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	//Prefixes of the temporary files created in MetaDirName
+	partialPrefix string = "partial-"
+	deltaPrefix   string = "delta-"
+
+	//Largest file we accept to fetch from a peer
+	MaxTransferSize int64 = 1 << 40
+)
+
+/**
+ * Download of a file from a peer that is still in progress
+ * hash, size and vector describe the content we are fetching, missing holds
+ * the chunk numbers that were not received yet and blocks the hashes used to
+ * verify them. The content is assembled in out, a temporary file, and only
+ * moved over the real file once complete. meta is the entry of the peer
+ * whose metadata the file gets then
+ **/
+type transfer struct {
+	peer    *Client
+	hash    []byte
+	size    int64
+	vector  VersionVector
+	blocks  [][]byte
+	missing map[int64]bool
+	meta    *FileEntry
+
+	out *os.File
+}
+
+/**
+ * Delta being applied against our copy of a file, basis is the current copy
+ **/
+type deltaTransfer struct {
+	transfer
+
+	blockSize int
+	started   bool
+
+	basis *os.File
+}
+
+/**
+ * Number of chunks of FileChunkSize needed to hold size bytes
+ **/
+func ChunkCount(size int64) int64 {
+	return (size + FileChunkSize - 1) / FileChunkSize
+}
+
+func newTransfer(peer *Client, remote *FileEntry, vector VersionVector) *transfer {
+	return &transfer{
+		peer:    peer,
+		hash:    remote.Hash,
+		vector:  vector,
+		missing: make(map[int64]bool),
+		meta:    remote,
+	}
+}
+
+func (t *transfer) Chunks() (chunks []int64) {
+	chunks = make([]int64, 0, len(t.missing))
+
+	for c := range t.missing {
+		chunks = append(chunks, c)
+	}
+
+	return
+}
+
+func (t *transfer) Done() bool {
+	return len(t.missing) == 0
+}
+
+/**
+ * Checks a received chunk against the block hashes sent by the peer
+ **/
+func (t *transfer) VerifyChunk(partnum int64, part []byte) bool {
+	if partnum < 0 || partnum >= int64(len(t.blocks)) {
+		return false
+	}
+
+	sum := sha1.Sum(part)
+
+	return bytes.Equal(sum[:], t.blocks[partnum])
+}
+
+/**
+ * Writes a received chunk in the temporary file
+ **/
+func (t *transfer) WriteChunk(partnum int64, part []byte) error {
+	if partnum < 0 || partnum >= ChunkCount(t.size) ||
+		int64(len(part)) > FileChunkSize ||
+		partnum*FileChunkSize+int64(len(part)) > t.size {
+		return errors.New("Invalid chunk received!")
+	}
+
+	_, err := t.out.WriteAt(part, partnum*FileChunkSize)
+
+	return err
+}
+
+/**
+ * Drops the transfer along with its temporary file
+ **/
+func (t *transfer) Abort() {
+	if t.out != nil {
+		t.out.Close()
+		os.Remove(t.out.Name())
+	}
+}
+
+/**
+ * Stops the transfer but keeps its temporary file so it can be resumed
+ **/
+func (t *transfer) Suspend() {
+	if t.out != nil {
+		t.out.Close()
+	}
+}
+
+func (t *deltaTransfer) Abort() {
+	t.basis.Close()
+	t.transfer.Abort()
+}
+
+/**
+ * Creates the temporary file in which the new content of file is assembled.
+ * It starts as a copy of the current content, truncated to size, so that
+ * unchanged blocks do not have to be fetched
+ **/
+func (s *Share) NewPartial(file string, size int64) (tmp *os.File, err error) {
+	tmp, err = s.TempFile(partialPrefix)
+
+	if err != nil {
+		return
+	}
+
+	current, err := s.OpenFile(file)
+
+	if err == nil {
+		_, err = io.Copy(tmp, io.LimitReader(current, size))
+		current.Close()
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+
+	if err == nil {
+		err = tmp.Truncate(size)
+	}
+
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return
+}
+
+var ErrLocalChange = errors.New("File changed locally during the transfer!")
+
+/**
+ * Tells whether file changed since it was last indexed. Its content is only
+ * hashed when its size, modification time or metadata differ
+ **/
+func (s *Share) changedLocally(file string) (changed bool, err error) {
+	changed, err = s.CheckFileShallow(file)
+
+	if err != nil || !changed {
+		return
+	}
+
+	entry, err := s.StoredEntry(file)
+
+	if err != nil || entry == nil || entry.Deleted {
+		return
+	}
+
+	stat, err := s.statFile(file)
+
+	if err != nil {
+		//Removed since it was indexed
+		return true, nil
+	}
+
+	hash, err := s.hashFile(file, stat)
+
+	if err != nil {
+		return
+	}
+
+	return !bytes.Equal(hash, entry.Hash), nil
+}
+
+/**
+ * Checks that tmp hashes to hash and atomically moves it over file, keeping
+ * the mode of the copy being replaced. ErrLocalChange is returned when file
+ * changed since it was indexed, its content is not replaced then. tmp is
+ * closed in any case and removed if it could not be moved
+ **/
+func (s *Share) CommitPartial(tmp *os.File, file string, hash []byte) (err error) {
+	defer func() {
+		tmp.Close()
+
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = tmp.Seek(0, 0)
+
+	if err != nil {
+		return
+	}
+
+	sum, _, err := HashBlocks(tmp)
+
+	if err != nil {
+		return
+	}
+
+	if !bytes.Equal(sum, hash) {
+		return errors.New("Hash mismatch for " + file)
+	}
+
+	changed, err := s.changedLocally(file)
+
+	if err != nil {
+		return
+	}
+
+	if changed {
+		return ErrLocalChange
+	}
+
+	target := path.Join(s.Path, file)
+
+	err = os.MkdirAll(path.Dir(target), 0755)
+
+	if err != nil {
+		return
+	}
+
+	//Temporary files are private, keep the mode of the copy being replaced
+	if stat, err := os.Stat(target); err == nil {
+		tmp.Chmod(stat.Mode())
+	} else {
+		tmp.Chmod(0644)
+	}
+
+	err = tmp.Sync()
+
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), target)
+}
+
+func (s *Share) OpenPartial(temp string) (*os.File, error) {
+	return os.OpenFile(path.Join(s.Path, MetaDirName, temp), os.O_RDWR, 0)
+}
+
+/**
+ * Removes the temporary files left by a crash that can not be resumed
+ **/
+func (s *Share) CleanTempFiles() error {
+	meta := path.Join(s.Path, MetaDirName)
+
+	temps, err := s.PartialTemps()
+
+	if err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(meta)
+
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+
+		if temps[name] {
+			continue
+		}
+
+		if strings.HasPrefix(name, partialPrefix) ||
+			strings.HasPrefix(name, deltaPrefix) {
+			LogObj.Println("Removing stale temporary file", name)
+			os.Remove(path.Join(meta, name))
+		}
+	}
+
+	return nil
+}
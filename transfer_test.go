@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"io/ioutil"
+	"lightsync/proto"
+	"path"
+	"testing"
+	"time"
+)
+
+/**
+ * Handler of a new indexed share, without its goroutine, in which peer is
+ * allowed and whose messages are kept in the channel of peer
+ **/
+func newTestHandler(t *testing.T, peer *Client) (sh *ShareHandler, cleanup func()) {
+	share, cleanup := TempIndexedShare(t)
+	share.Config.AuthorizedClients = []string{peer.Name()}
+
+	sh = &ShareHandler{
+		Share:     *share,
+		transfers: make(map[string]*transfer),
+		deltas:    make(map[string]*deltaTransfer),
+		renames:   newRenameDetector(),
+		applied:   make(map[string]*remoteWrite),
+		batches:   make(map[string][]*indexBatch),
+		walks:     make(map[string]*treeWalk),
+	}
+
+	return
+}
+
+func newTestPeer(name string) *Client {
+	return &Client{inputCh: make(chan Message, 10), name: name}
+}
+
+func TestResumeOnEnter(t *testing.T) {
+	file, content := "resumed.txt", []byte("content being fetched")
+	hash, blocks, _ := HashBlocks(bytes.NewReader(content))
+
+	peer := newTestPeer("resume-peer")
+	sh, cleanup := newTestHandler(t, peer)
+	defer cleanup()
+
+	mtime := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC).Unix()
+
+	sh.RequestBlockList(peer, &FileEntry{Path: file, Hash: hash, Mode: 0755,
+		HasMode: true, ModTime: mtime}, VersionVector{})
+
+	sh.HandleBlockList(&BlockListWrapper{MessageWrapper{peer}, &light.BlockList{
+		Filename:  proto.String(file),
+		ShareName: proto.String(sh.Name),
+		Hash:      hash,
+		Size:      proto.Int64(int64(len(content))),
+		Blocks:    blocks,
+	}})
+
+	if len(peer.inputCh) != 2 {
+		t.Fatal("Chunks not requested: ", len(peer.inputCh))
+	}
+
+	<-peer.inputCh
+	<-peer.inputCh
+
+	//Peer disconnects before sending anything
+	sh.SuspendTransfers(peer)
+
+	if p, err := sh.StoredPartial(file); err != nil || p == nil || p.Peer != peer.Name() {
+		t.Fatal("Partial download not kept: ", p, err)
+	}
+
+	//And comes back without announcing the file again
+	sh.Enter(peer)
+	defer sh.RemoveClient(peer)
+
+	if len(peer.inputCh) != 2 {
+		t.Fatal("Unexpected messages on entering: ", len(peer.inputCh))
+	}
+
+	<-peer.inputCh
+	req, ok := (<-peer.inputCh).(*ChunkRequestWrapper)
+
+	if !ok || req.GetFilename() != file || len(req.GetChunks()) != 0 {
+		t.Error("Block list not requested again: ", req)
+	}
+
+	tr, pending := sh.transfers[file]
+
+	if !pending || tr.peer != peer {
+		t.Fatal("Transfer not resumed")
+	}
+
+	if tr.meta == nil || tr.meta.Mode != 0755 || tr.meta.ModTime != mtime {
+		t.Error("Metadata of the peer lost on resuming: ", tr.meta)
+	}
+
+	sh.abortTransfer(file, tr)
+}
+
+func TestSequenceAfterCommit(t *testing.T) {
+	file, content := "pulled.txt", []byte("content of the peer")
+	hash, blocks, _ := HashBlocks(bytes.NewReader(content))
+
+	peer := newTestPeer("index-peer")
+	sh, cleanup := newTestHandler(t, peer)
+	defer cleanup()
+
+	sh.StorePeerSequence(peer.Name(), "", 0)
+
+	vector := VersionVector{peer.Name(): 1}
+
+	sh.HandleIndex(&IndexMessageWrapper{MessageWrapper{peer}, &light.IndexMessage{
+		ShareName: proto.String(sh.Name),
+		IndexId:   proto.String("peer-index"),
+		Sequence:  proto.Int64(42),
+		Files: []*light.IndexEntry{{
+			Filename: proto.String(file),
+			Hash:     hash,
+			Size:     proto.Int64(int64(len(content))),
+			Version:  vector.Proto(),
+		}},
+	}})
+
+	if _, since, _ := sh.PeerSequence(peer.Name()); since != 0 {
+		t.Fatal("Sequence stored before the file was fetched: ", since)
+	}
+
+	sh.HandleBlockList(&BlockListWrapper{MessageWrapper{peer}, &light.BlockList{
+		Filename:  proto.String(file),
+		ShareName: proto.String(sh.Name),
+		Hash:      hash,
+		Size:      proto.Int64(int64(len(content))),
+		Blocks:    blocks,
+	}})
+
+	sh.HandleChunkData(&ChunkDataWrapper{MessageWrapper{peer}, &light.ChunkData{
+		Filename:  proto.String(file),
+		ShareName: proto.String(sh.Name),
+		Hash:      hash,
+		Chunk:     proto.Int64(0),
+		Data:      content,
+	}})
+
+	if id, since, err := sh.PeerSequence(peer.Name()); id != "peer-index" || since != 42 {
+		t.Error("Sequence not stored once the file was fetched: ", id, since, err)
+	}
+}
+
+func TestChunkRequestAsync(t *testing.T) {
+	file, content := "served.txt", []byte("content being served")
+
+	//Nothing is sent until the peer reads
+	peer := &Client{inputCh: make(chan Message), name: "chunk-peer"}
+	sh, cleanup := newTestHandler(t, peer)
+	defer cleanup()
+
+	//Files we may not write to are served as well
+	err := ioutil.WriteFile(path.Join(sh.Path, file), content, 0444)
+
+	if err == nil {
+		_, err = sh.CheckFileDeep(file)
+	}
+
+	if err != nil {
+		t.Fatal("Could not index served file: ", err)
+	}
+
+	hash, _ := sh.StoredHash(file)
+	done := make(chan bool)
+
+	go func() {
+		sh.HandleChunkRequest(&ChunkRequestWrapper{MessageWrapper{peer},
+			&light.ChunkRequest{
+				Filename:  proto.String(file),
+				ShareName: proto.String(sh.Name),
+				Hash:      hash,
+				Chunks:    []int64{0},
+			}})
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Handler blocked while sending chunks")
+	}
+
+	data, ok := (<-peer.inputCh).(*ChunkDataWrapper)
+
+	if !ok || !bytes.Equal(data.GetData(), content) {
+		t.Error("Unexpected chunk sent: ", data)
+	}
+
+	//Chunks of another version are refused
+	go sh.HandleChunkRequest(&ChunkRequestWrapper{MessageWrapper{peer},
+		&light.ChunkRequest{
+			Filename:  proto.String(file),
+			ShareName: proto.String(sh.Name),
+			Hash:      StrongChecksum([]byte("older content")),
+			Chunks:    []int64{0},
+		}})
+
+	list, ok := (<-peer.inputCh).(*BlockListWrapper)
+
+	if !ok || !bytes.Equal(list.GetHash(), hash) {
+		t.Error("Chunks of another version served: ", list)
+	}
+}
+
+func TestDeltaRequestAsync(t *testing.T) {
+	file, content := "patched.txt", []byte("content being diffed")
+
+	//Nothing is sent until the peer reads
+	peer := &Client{inputCh: make(chan Message), name: "delta-peer"}
+	sh, cleanup := newTestHandler(t, peer)
+	defer cleanup()
+
+	err := ioutil.WriteFile(path.Join(sh.Path, file), content, 0644)
+
+	if err == nil {
+		_, err = sh.CheckFileDeep(file)
+	}
+
+	if err != nil {
+		t.Fatal("Could not index diffed file: ", err)
+	}
+
+	done := make(chan bool)
+
+	go func() {
+		sh.HandleDeltaRequest(&DeltaRequestWrapper{MessageWrapper{peer},
+			&light.DeltaRequest{
+				Filename:  proto.String(file),
+				ShareName: proto.String(sh.Name),
+				BlockSize: proto.Int32(int32(DeltaBlockSize)),
+			}})
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Handler blocked while sending the delta")
+	}
+
+	data, ok := (<-peer.inputCh).(*DeltaDataWrapper)
+
+	if !ok || !data.GetLast() || len(data.GetOps()) != 1 ||
+		!bytes.Equal(data.GetOps()[0].GetLiteral(), content) {
+		t.Error("Unexpected delta sent: ", data)
+	}
+}
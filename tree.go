@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"path"
+)
+
+const (
+	//Path of the root of a share in the tree
+	TreeRoot string = "."
+)
+
+/**
+ * Node of the Merkle tree summing up a share. The hash of a file covers its
+ * content and version, the hash of a folder covers the names and hashes of
+ * its children, so two peers with the same root hash agree on the whole
+ * share. Removed files and empty folders are left out of the tree
+ **/
+type TreeNode struct {
+	Path   string
+	Folder bool
+	Hash   []byte
+}
+
+func treeLeafHash(hash []byte, vector string) []byte {
+	h := sha1.New()
+
+	h.Write(hash)
+	h.Write([]byte(vector))
+
+	return h.Sum(nil)
+}
+
+/**
+ * Stores the leaf of file, or removes it if leaf is nil, and marks all the
+ * folders above it as needing their hash recomputed
+ **/
+func updateTree(tx *sql.Tx, file string, leaf []byte) (err error) {
+	if leaf == nil {
+		_, err = tx.Exec("DELETE FROM tree WHERE path = ?", file)
+	} else {
+		_, err = tx.Exec("INSERT OR REPLACE INTO tree (path, parent, folder, hash) "+
+			"VALUES (?, ?, 0, ?)", file, path.Dir(file), leaf)
+	}
+
+	for dir := path.Dir(file); err == nil; dir = path.Dir(dir) {
+		parent := path.Dir(dir)
+
+		if dir == TreeRoot {
+			parent = ""
+		}
+
+		_, err = tx.Exec("INSERT OR REPLACE INTO tree (path, parent, folder, hash) "+
+			"VALUES (?, ?, 1, NULL)", dir, parent)
+
+		if dir == TreeRoot {
+			break
+		}
+	}
+
+	return
+}
+
+/**
+ * Builds the tree of an index created before the tree existed
+ **/
+func initTree(db *sql.DB) (err error) {
+	var nodes int
+
+	err = db.QueryRow("SELECT COUNT(*) FROM tree").Scan(&nodes)
+
+	if err != nil || nodes > 0 {
+		return
+	}
+
+	rows, err := db.Query(
+		"SELECT path, hash, vector FROM files WHERE deleted = 0")
+
+	if err != nil {
+		return
+	}
+
+	leaves := make(map[string][]byte)
+
+	for rows.Next() {
+		var file, vector string
+		var hash []byte
+
+		err = rows.Scan(&file, &hash, &vector)
+
+		if err != nil {
+			rows.Close()
+			return
+		}
+
+		leaves[file] = treeLeafHash(hash, vector)
+	}
+
+	rows.Close()
+
+	if len(leaves) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		return
+	}
+
+	for file, leaf := range leaves {
+		err = updateTree(tx, file, leaf)
+
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+/**
+ * Returns the hash of the node at file, computing the hashes of the folders
+ * changed since the last call. The hash is nil if there is no such node or
+ * if it is an empty folder
+ **/
+func (s *Share) TreeHash(file string) (hash []byte, err error) {
+	var folder int
+
+	err = s.Database.QueryRow("SELECT folder, hash FROM tree WHERE path = ?",
+		file).Scan(&folder, &hash)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil || hash != nil || folder == 0 {
+		return
+	}
+
+	children, err := s.TreeChildren(file)
+
+	if err != nil || len(children) == 0 {
+		return nil, err
+	}
+
+	h := sha1.New()
+
+	for _, c := range children {
+		h.Write([]byte(path.Base(c.Path)))
+		h.Write([]byte{0})
+		h.Write(c.Hash)
+	}
+
+	hash = h.Sum(nil)
+
+	_, err = s.Database.Exec("UPDATE tree SET hash = ? WHERE path = ?", hash, file)
+
+	return
+}
+
+/**
+ * Returns the nodes right below folder dir, sorted by path
+ **/
+func (s *Share) TreeChildren(dir string) (children []TreeNode, err error) {
+	rows, err := s.Database.Query("SELECT path, folder, hash FROM tree "+
+		"WHERE parent = ? ORDER BY path", dir)
+
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		var n TreeNode
+		var folder int
+
+		err = rows.Scan(&n.Path, &folder, &n.Hash)
+
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		n.Folder = folder != 0
+		children = append(children, n)
+	}
+
+	rows.Close()
+
+	//Hashes of modified folders are computed once the rows are released
+	nodes := children[:0]
+
+	for _, c := range children {
+		if c.Hash == nil {
+			c.Hash, err = s.TreeHash(c.Path)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if c.Hash != nil {
+			nodes = append(nodes, c)
+		}
+	}
+
+	return nodes, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"lightsync/proto"
+)
+
+/**
+ * Tree comparison started with a peer. sequence is the one of our index when
+ * it started and pending the number of folders the peer did not answer yet
+ **/
+type treeWalk struct {
+	indexID  string
+	sequence int64
+	pending  int
+}
+
+/**
+ * Starts comparing our tree with the one of peer from the root
+ * Each side lists a folder whose hash differs, sends the index entries of
+ * its differing files and the side that listed first goes down into the
+ * differing subfolders, so finding a change takes one round trip per level.
+ * Once every folder was answered, the peer is told up to which sequence of
+ * which index it has seen our files
+ **/
+func (sh *ShareHandler) CompareTree(peer *Client, indexID string) {
+	sequence, err := sh.MaxSequence()
+
+	if err != nil {
+		LogObj.Println("Could not read index of share", sh.Name, ":", err)
+		return
+	}
+
+	sh.walks[peer.Name()] = &treeWalk{indexID: indexID, sequence: sequence}
+
+	sh.sendTree(peer, TreeRoot, false)
+}
+
+func (sh *ShareHandler) sendTree(peer *Client, dir string, reply bool) {
+	if w := sh.walks[peer.Name()]; w != nil && !reply {
+		w.pending++
+	}
+
+	hash, err := sh.TreeHash(dir)
+
+	if err != nil {
+		LogObj.Println("Could not hash folder", dir, ":", err)
+		return
+	}
+
+	children, err := sh.TreeChildren(dir)
+
+	if err != nil {
+		LogObj.Println("Could not list folder", dir, ":", err)
+		return
+	}
+
+	nodes := make([]*light.TreeNode, len(children))
+
+	for i, c := range children {
+		nodes[i] = &light.TreeNode{
+			Path:   proto.String(c.Path),
+			Folder: proto.Bool(c.Folder),
+			Hash:   c.Hash,
+		}
+	}
+
+	peer.WriteMessage(&TreeMessageWrapper{MessageWrapper{nil},
+		&light.TreeMessage{
+			ShareName: proto.String(sh.Name),
+			Path:      proto.String(dir),
+			Hash:      hash,
+			Children:  nodes,
+			Reply:     proto.Bool(reply),
+		}})
+}
+
+/**
+ * Compares the listing of a folder of a peer with ours. Our entries of the
+ * files that differ are sent so the peer can reconcile them
+ **/
+func (sh *ShareHandler) HandleTree(msg *TreeMessageWrapper) {
+	if msg.GetShareName() != sh.Name {
+		LogObj.Println("Ignoring message meant for share", msg.GetShareName())
+		return
+	}
+
+	peer, dir := msg.Sender(), msg.GetPath()
+
+	if msg.GetReply() {
+		defer sh.treeAnswered(peer)
+	}
+
+	hash, err := sh.TreeHash(dir)
+
+	if err != nil {
+		LogObj.Println("Could not hash folder", dir, ":", err)
+		return
+	}
+
+	if bytes.Equal(hash, msg.GetHash()) {
+		if dir == TreeRoot {
+			//Same files on both sides, the peer knows about all our removals
+			sh.acknowledgeAll(peer)
+
+			if !msg.GetReply() {
+				sh.sendTree(peer, dir, true)
+			}
+		}
+		return
+	}
+
+	local, err := sh.TreeChildren(dir)
+
+	if err != nil {
+		LogObj.Println("Could not list folder", dir, ":", err)
+		return
+	}
+
+	remote := make(map[string]*light.TreeNode)
+
+	for _, n := range msg.GetChildren() {
+		remote[n.GetPath()] = n
+	}
+
+	var entries []*light.IndexEntry
+	var folders []string
+
+	for _, n := range local {
+		r := remote[n.Path]
+		delete(remote, n.Path)
+
+		if r != nil && bytes.Equal(r.GetHash(), n.Hash) {
+			continue
+		}
+
+		if n.Folder {
+			folders = append(folders, n.Path)
+			continue
+		}
+
+		e, err := sh.StoredEntry(n.Path)
+
+		if err != nil || e == nil {
+			LogObj.Println("Could not read index entry of", n.Path, ":", err)
+			continue
+		}
+
+		entries = append(entries, entryToProto(e))
+	}
+
+	//Folders we do not have are walked as well so the peer sends their files,
+	//files we do not have may be ones we removed
+	for _, r := range remote {
+		if r.GetFolder() {
+			folders = append(folders, r.GetPath())
+			continue
+		}
+
+		e, err := sh.StoredEntry(r.GetPath())
+
+		if err == nil && e != nil {
+			entries = append(entries, entryToProto(e))
+		}
+	}
+
+	for len(entries) > 0 {
+		n := nextIndexBatch(entries, indexBatchBytes)
+
+		peer.WriteMessage(&IndexMessageWrapper{MessageWrapper{nil},
+			&light.IndexMessage{
+				ShareName: proto.String(sh.Name),
+				Files:     entries[:n],
+			}})
+
+		entries = entries[n:]
+	}
+
+	if !msg.GetReply() {
+		sh.sendTree(peer, dir, true)
+		return
+	}
+
+	for _, f := range folders {
+		sh.sendTree(peer, f, false)
+	}
+}
+
+/**
+ * Called once peer answered one of the folders of our walk, the last answer
+ * ends it. Our files it was sent are older than the sequence the walk
+ * started with, the ones changed since were announced to it
+ **/
+func (sh *ShareHandler) treeAnswered(peer *Client) {
+	w := sh.walks[peer.Name()]
+
+	if w == nil {
+		return
+	}
+
+	w.pending--
+
+	if w.pending > 0 {
+		return
+	}
+
+	delete(sh.walks, peer.Name())
+
+	peer.WriteMessage(&IndexMessageWrapper{MessageWrapper{nil},
+		&light.IndexMessage{
+			ShareName: proto.String(sh.Name),
+			IndexId:   proto.String(w.indexID),
+			Sequence:  proto.Int64(w.sequence),
+			Last:      proto.Bool(true),
+		}})
+
+	LogObj.Println("Tree of share", sh.Name, "compared with", peer.Name())
+}
+
+func (sh *ShareHandler) acknowledgeAll(peer *Client) {
+	sequence, err := sh.MaxSequence()
+
+	if err != nil {
+		LogObj.Println("Could not read index of share", sh.Name, ":", err)
+		return
+	}
+
+	sh.Acknowledge(peer, sequence)
+}
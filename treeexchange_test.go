@@ -0,0 +1,97 @@
+package main
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"lightsync/proto"
+	"testing"
+)
+
+func TestTreeWalkSequence(t *testing.T) {
+	peer := newTestPeer("tree-peer")
+	sh, cleanup := newTestHandler(t, peer)
+	defer cleanup()
+
+	sequence, err := sh.MaxSequence()
+
+	if err != nil {
+		t.Fatal("Could not read sequence: ", err)
+	}
+
+	sh.CompareTree(peer, "our-index")
+
+	if len(peer.inputCh) != 1 {
+		t.Fatal("Unexpected messages on starting the walk: ", len(peer.inputCh))
+	}
+
+	root, ok := (<-peer.inputCh).(*TreeMessageWrapper)
+
+	if !ok || root.GetReply() {
+		t.Fatal("Root not sent: ", root)
+	}
+
+	//Peer has the same files
+	sh.HandleTree(&TreeMessageWrapper{MessageWrapper{peer}, &light.TreeMessage{
+		ShareName: proto.String(sh.Name),
+		Path:      proto.String(TreeRoot),
+		Hash:      root.GetHash(),
+		Reply:     proto.Bool(true),
+	}})
+
+	if len(peer.inputCh) != 1 {
+		t.Fatal("Unexpected messages on ending the walk: ", len(peer.inputCh))
+	}
+
+	msg, ok := (<-peer.inputCh).(*IndexMessageWrapper)
+
+	if !ok || msg.GetIndexId() != "our-index" || msg.GetSequence() != sequence ||
+		len(msg.GetFiles()) != 0 {
+		t.Error("Walk not ended with the sequence it started with: ", msg)
+	}
+
+	if len(sh.walks) != 0 {
+		t.Error("Walk still pending: ", sh.walks)
+	}
+}
+
+func TestIndexBatchBytes(t *testing.T) {
+	entries := make([]*light.IndexEntry, 10)
+
+	for i := range entries {
+		entries[i] = &light.IndexEntry{
+			Filename: proto.String("file"),
+			Hash:     make([]byte, 1000),
+		}
+	}
+
+	maxBytes := 3500
+
+	for len(entries) > 0 {
+		n := nextIndexBatch(entries, maxBytes)
+
+		if n == 0 {
+			t.Fatal("Empty batch")
+		}
+
+		size := proto.Size(&light.IndexMessage{Files: entries[:n]})
+
+		if size > maxBytes {
+			t.Error("Batch of", n, "files takes", size, "bytes")
+		}
+
+		if n < len(entries) && size+indexEntrySize(entries[n]) <= maxBytes {
+			t.Error("Batch of", n, "files not filled")
+		}
+
+		entries = entries[n:]
+	}
+
+	//Too large for any batch, it still goes alone
+	large := []*light.IndexEntry{
+		{Hash: make([]byte, 2*maxBytes)},
+		{Hash: make([]byte, 10)},
+	}
+
+	if n := nextIndexBatch(large, maxBytes); n != 1 {
+		t.Error("Large file not sent alone:", n)
+	}
+}
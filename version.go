@@ -0,0 +1,169 @@
+package main
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"lightsync/proto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Per file version vector: number of changes made by each peer, keyed by
+ * the fingerprint of its key
+ **/
+type VersionVector map[string]uint64
+
+type VersionOrder int
+
+const (
+	VersionEqual VersionOrder = iota
+	VersionNewer
+	VersionOlder
+	VersionConcurrent
+)
+
+func (v VersionVector) Copy() VersionVector {
+	c := make(VersionVector, len(v))
+
+	for id, n := range v {
+		c[id] = n
+	}
+
+	return c
+}
+
+/**
+ * Returns a copy of v with the counter of id bumped
+ **/
+func (v VersionVector) Increment(id string) VersionVector {
+	c := v.Copy()
+	c[id]++
+	return c
+}
+
+/**
+ * Returns the smallest vector that descends from both v and other
+ **/
+func (v VersionVector) Merge(other VersionVector) VersionVector {
+	c := v.Copy()
+
+	for id, n := range other {
+		if n > c[id] {
+			c[id] = n
+		}
+	}
+
+	return c
+}
+
+/**
+ * Tells how v relates to other: VersionNewer means v descends from other
+ **/
+func (v VersionVector) Compare(other VersionVector) VersionOrder {
+	newer, older := false, false
+
+	for id, n := range v {
+		if n > other[id] {
+			newer = true
+		}
+	}
+
+	for id, n := range other {
+		if n > v[id] {
+			older = true
+		}
+	}
+
+	switch {
+	case newer && older:
+		return VersionConcurrent
+	case newer:
+		return VersionNewer
+	case older:
+		return VersionOlder
+	}
+
+	return VersionEqual
+}
+
+/**
+ * Encodes v as "id:counter" pairs sorted by id for storage in the index.
+ * Counters without an id could not be parsed back and are left out
+ **/
+func (v VersionVector) String() string {
+	ids := make([]string, 0, len(v))
+
+	for id := range v {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+
+	for i, id := range ids {
+		ids[i] = id + ":" + strconv.FormatUint(v[id], 10)
+	}
+
+	return strings.Join(ids, ",")
+}
+
+func ParseVersionVector(s string) (v VersionVector, err error) {
+	v = make(VersionVector)
+
+	if len(s) == 0 {
+		return
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		idx := strings.LastIndex(pair, ":")
+
+		if idx < 0 {
+			return nil, errors.New("Invalid version counter " + pair)
+		}
+
+		//Counter of changes made before we had a fingerprint, dropped
+		if idx == 0 {
+			continue
+		}
+
+		n, err := strconv.ParseUint(pair[idx+1:], 10, 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		v[pair[:idx]] = n
+	}
+
+	return
+}
+
+func (v VersionVector) Proto() (counters []*light.VersionCounter) {
+	for id, n := range v {
+		if id == "" {
+			continue
+		}
+
+		counters = append(counters, &light.VersionCounter{
+			Id:    proto.String(id),
+			Value: proto.Uint64(n),
+		})
+	}
+
+	return
+}
+
+func VersionVectorFromProto(counters []*light.VersionCounter) (v VersionVector) {
+	v = make(VersionVector, len(counters))
+
+	for _, c := range counters {
+		if c.GetId() != "" {
+			v[c.GetId()] = c.GetValue()
+		}
+	}
+
+	return
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestVersionCompare(t *testing.T) {
+	a := VersionVector{"alice": 2, "bob": 1}
+
+	if a.Compare(a.Copy()) != VersionEqual {
+		t.Error("Vector should be equal to its copy!")
+	}
+
+	b := a.Increment("bob")
+
+	if b.Compare(a) != VersionNewer || a.Compare(b) != VersionOlder {
+		t.Error("Incremented vector should descend from the original!")
+	}
+
+	c := a.Increment("alice")
+
+	if b.Compare(c) != VersionConcurrent {
+		t.Error("Concurrent edits not detected!")
+	}
+
+	if m := b.Merge(c); m.Compare(b) != VersionNewer || m.Compare(c) != VersionNewer {
+		t.Error("Merged vector should descend from both vectors!")
+	}
+
+	if (VersionVector{}).Compare(nil) != VersionEqual {
+		t.Error("Empty vectors should be equal!")
+	}
+}
+
+func TestVersionEncoding(t *testing.T) {
+	v := VersionVector{"bob": 3, "alice": 12}
+
+	if v.String() != "alice:12,bob:3" {
+		t.Error("Unexpected encoding ", v.String())
+	}
+
+	parsed, err := ParseVersionVector(v.String())
+
+	if err != nil || parsed.Compare(v) != VersionEqual {
+		t.Error("Could not decode vector: ", err)
+	}
+
+	if _, err = ParseVersionVector("alice"); err == nil {
+		t.Error("Invalid vector was accepted!")
+	}
+
+	if s := v.Increment("").String(); s != "alice:12,bob:3" {
+		t.Error("Counter without id encoded: ", s)
+	}
+
+	if parsed, err = ParseVersionVector(":1,bob:3"); err != nil || len(parsed) != 1 {
+		t.Error("Counter without id not dropped: ", parsed, err)
+	}
+}
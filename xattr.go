@@ -0,0 +1,171 @@
+package main
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/json"
+	"lightsync/proto"
+	"os"
+	"path"
+	"sort"
+)
+
+const (
+	//Largest size of the extended attributes of a file, names included
+	DefaultMaxXattrSize int = 64 * 1024
+)
+
+/**
+ * File capabilities grant privileges like setuid bits do, they are never
+ * taken from peers. POSIX ACLs are stored in system.posix_acl_* attributes
+ * and synced with the others
+ **/
+func syncedXattr(name string) bool {
+	return name != "security.capability"
+}
+
+func (s *Share) MaxXattrSize() int {
+	if s.Config.MaxXattrSize > 0 {
+		return s.Config.MaxXattrSize
+	}
+
+	return DefaultMaxXattrSize
+}
+
+/**
+ * Returns the extended attributes of file, described by stat, as indexed.
+ * nil means they are not synced: the share does not sync them, file is a
+ * symlink, they could not be read or they exceed MaxXattrSize
+ **/
+func (s *Share) readXattrs(file string, stat os.FileInfo) map[string][]byte {
+	if !s.Config.SyncXattrs || isSymlink(stat) {
+		return nil
+	}
+
+	attrs, err := getXattrs(path.Join(s.Path, file))
+
+	if err != nil {
+		LogObj.Println("Could not read extended attributes of", file, ":", err)
+		return nil
+	}
+
+	for name := range attrs {
+		if !syncedXattr(name) {
+			delete(attrs, name)
+		}
+	}
+
+	if xattrsSize(attrs) > s.MaxXattrSize() {
+		LogObj.Println("Extended attributes of", file, "exceed", s.MaxXattrSize(),
+			"bytes, not syncing them")
+		return nil
+	}
+
+	return attrs
+}
+
+func xattrsSize(attrs map[string][]byte) (size int) {
+	for name, value := range attrs {
+		size += len(name) + len(value)
+	}
+
+	return
+}
+
+/**
+ * Tells whether the extended attributes of remote, the entry of a peer,
+ * match the ones of local. Unknown ones always match
+ **/
+func (s *Share) sameXattrs(local, remote map[string][]byte) bool {
+	if !s.Config.SyncXattrs || remote == nil {
+		return true
+	}
+
+	return encodeXattrs(local) == encodeXattrs(remote)
+}
+
+/**
+ * Encoding of attrs stored in the index, empty when they are not synced
+ **/
+func encodeXattrs(attrs map[string][]byte) string {
+	if attrs == nil {
+		return ""
+	}
+
+	//Keys are sorted, equal sets are encoded the same way
+	encoded, _ := json.Marshal(attrs)
+
+	return string(encoded)
+}
+
+func decodeXattrs(encoded string) (attrs map[string][]byte, err error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	err = json.Unmarshal([]byte(encoded), &attrs)
+
+	if err == nil && attrs == nil {
+		attrs = make(map[string][]byte)
+	}
+
+	return
+}
+
+func xattrsToProto(attrs map[string][]byte) *light.XattrSet {
+	if attrs == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(attrs))
+
+	for name := range attrs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	set := &light.XattrSet{}
+
+	for _, name := range names {
+		set.Attrs = append(set.Attrs, &light.Xattr{
+			Name:  proto.String(name),
+			Value: attrs[name],
+		})
+	}
+
+	return set
+}
+
+func xattrsFromProto(set *light.XattrSet) map[string][]byte {
+	if set == nil {
+		return nil
+	}
+
+	attrs := make(map[string][]byte)
+
+	for _, a := range set.GetAttrs() {
+		if syncedXattr(a.GetName()) {
+			attrs[a.GetName()] = a.GetValue()
+		}
+	}
+
+	return attrs
+}
+
+/**
+ * Gives full the extended attributes of meta if the share syncs them. Sets
+ * exceeding MaxXattrSize are dropped like the ones we read
+ **/
+func (s *Share) applyXattrs(full string, meta *FileEntry) error {
+	if !s.Config.SyncXattrs || meta.Xattrs == nil {
+		return nil
+	}
+
+	if xattrsSize(meta.Xattrs) > s.MaxXattrSize() {
+		LogObj.Println("Extended attributes received for", meta.Path, "exceed",
+			s.MaxXattrSize(), "bytes, not applying them")
+		return nil
+	}
+
+	return setXattrs(full, meta.Xattrs)
+}
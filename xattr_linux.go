@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+)
+
+/**
+ * Reads the extended attributes of full, following symlinks. Returns nil
+ * when the file system does not support them
+ **/
+func getXattrs(full string) (attrs map[string][]byte, err error) {
+	size, err := syscall.Listxattr(full, nil)
+
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, size)
+
+	size, err = syscall.Listxattr(full, buf)
+
+	if err != nil {
+		return
+	}
+
+	attrs = make(map[string][]byte)
+
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		value, err := getXattr(full, name)
+
+		if err == syscall.ENODATA {
+			//Removed in the meantime
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		attrs[name] = value
+	}
+
+	return
+}
+
+func getXattr(full, name string) (value []byte, err error) {
+	size, err := syscall.Getxattr(full, name, nil)
+
+	if err != nil {
+		return
+	}
+
+	value = make([]byte, size)
+
+	size, err = syscall.Getxattr(full, name, value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return value[:size], nil
+}
+
+/**
+ * Gives full the extended attributes attrs, removing the ones it has that
+ * attrs does not. Every attribute is tried, the first error is returned
+ **/
+func setXattrs(full string, attrs map[string][]byte) (err error) {
+	current, err := getXattrs(full)
+
+	if err != nil {
+		return
+	}
+
+	for name := range current {
+		if _, keep := attrs[name]; keep || !syncedXattr(name) {
+			continue
+		}
+
+		if e := syscall.Removexattr(full, name); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	for name, value := range attrs {
+		if old, ok := current[name]; ok && bytes.Equal(old, value) {
+			continue
+		}
+
+		if e := syscall.Setxattr(full, name, value, 0); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
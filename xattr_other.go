@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+/**
+ * Extended attributes are only supported on Linux, files are indexed
+ * without any elsewhere
+ **/
+func getXattrs(full string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func setXattrs(full string, attrs map[string][]byte) error {
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestXattrEncoding(t *testing.T) {
+	attrs := map[string][]byte{
+		"user.tag":                []byte("blue"),
+		"system.posix_acl_access": {2, 0, 0, 0},
+	}
+
+	decoded, err := decodeXattrs(encodeXattrs(attrs))
+
+	if err != nil || encodeXattrs(decoded) != encodeXattrs(attrs) {
+		t.Error("Attributes changed when stored:", decoded, err)
+	}
+
+	if none, err := decodeXattrs(encodeXattrs(nil)); err != nil || none != nil {
+		t.Error("Attributes not synced decoded as", none, err)
+	}
+
+	if empty, err := decodeXattrs(encodeXattrs(map[string][]byte{})); err != nil ||
+		empty == nil || len(empty) != 0 {
+		t.Error("File without attributes decoded as", empty, err)
+	}
+
+	attrs["security.capability"] = []byte{1}
+	received := xattrsFromProto(xattrsToProto(attrs))
+
+	if _, ok := received["security.capability"]; ok || len(received) != 2 {
+		t.Error("Unexpected attributes received:", received)
+	}
+
+	if xattrsFromProto(xattrsToProto(nil)) != nil {
+		t.Error("Attributes not synced received as synced")
+	}
+}
+
+func TestXattrSizeCap(t *testing.T) {
+	s, cleanup := TempShare(t)
+	defer cleanup()
+
+	root := s.Path
+
+	full := path.Join(root, "file")
+	ioutil.WriteFile(full, []byte("content"), 0644)
+
+	s.Config.SyncXattrs = true
+	s.Config.MaxXattrSize = 64
+
+	err := setXattrs(full, map[string][]byte{"user.tag": []byte("blue")})
+	stat, _ := os.Stat(full)
+
+	if err != nil || s.readXattrs("file", stat) == nil {
+		t.Skip("Extended attributes not supported here: ", err)
+	}
+
+	if attrs := s.readXattrs("file", stat); string(attrs["user.tag"]) != "blue" {
+		t.Error("Attribute not read back:", attrs)
+	}
+
+	err = setXattrs(full, map[string][]byte{
+		"user.tag": []byte(strings.Repeat("x", 64))})
+
+	if err != nil {
+		t.Fatal("Could not set attribute: ", err)
+	}
+
+	if attrs := s.readXattrs("file", stat); attrs != nil {
+		t.Error("Attributes above the cap synced:", attrs)
+	}
+
+	err = s.applyXattrs(full, &FileEntry{Path: "file",
+		Xattrs: map[string][]byte{"user.tag": []byte(strings.Repeat("y", 64))}})
+
+	if attrs, _ := getXattrs(full); err != nil ||
+		string(attrs["user.tag"]) != strings.Repeat("x", 64) {
+		t.Error("Received attributes above the cap applied:", attrs, err)
+	}
+}